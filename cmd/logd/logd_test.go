@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+func newTestServer(t *testing.T) (*server, string) {
+	dir, err := os.MkdirTemp("", "logd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newServer(config{
+		tcpAddr:  "127.0.0.1:0",
+		unixPath: filepath.Join(dir, "logd.sock"),
+		dir:      filepath.Join(dir, "out"),
+		rotate:   "size",
+		maxBytes: 1 << 20,
+		backups:  3,
+		maxFrame: 1024,
+		grace:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serve()
+	return s, dir
+}
+
+func waitFrames(t *testing.T, s *server, n int64) {
+	for i := 0; i < 500; i++ {
+		if s.stats().Frames >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("frames=%d, want %d", s.stats().Frames, n)
+}
+
+func TestLogd(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	addrs := s.addrs()
+	for _, addr := range addrs {
+		h, err := log.NewSocketHandler(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.SetWriteIOThread(log.NewHandleIOWriteThread("testLogd-"+addr.Network(), 1024))
+		logger := log.NewLogger(h, log.Llevel)
+		for i := 0; i < 100; i++ {
+			logger.Info("%s record %d", addr.Network(), i)
+		}
+		logger.Close()
+	}
+	waitFrames(t, s, 200)
+
+	// 统计
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var st Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Connections != 2 || st.Frames != 200 ||
+		st.Sources["127.0.0.1"].Frames != 100 || st.Sources["unix"].Frames != 100 {
+		t.Fatalf("unexpected stats: %s", w.Body.String())
+	}
+
+	s.shutdown()
+
+	for source, network := range map[string]string{"127.0.0.1": "tcp", "unix": "unix"} {
+		data, err := os.ReadFile(filepath.Join(dir, "out", source+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 100 {
+			t.Fatalf("%s: %d lines", source, len(lines))
+		}
+		for i, line := range lines {
+			if want := fmt.Sprintf("INFO - %s record %d", network, i); line != want {
+				t.Fatalf("%s: got %q, want %q", source, line, want)
+			}
+		}
+	}
+}
+
+// v1、v2 混用，v2 帧按 主机名.app 分文件
+func TestLogdFrameV2(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	c, err := net.Dial("tcp", s.addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []byte
+	stream = logframe.AppendV1(stream, []byte("v1 record"))
+	stream = logframe.AppendV2(stream,
+		&logframe.Header{Hostname: "web-1", App: "api"}, []byte("api record\n"))
+	stream = logframe.AppendV2(stream,
+		&logframe.Header{Hostname: "web-1", App: "job"}, []byte("job record"))
+	stream = logframe.AppendV2(stream,
+		&logframe.Header{Hostname: "web-1", App: "api"}, []byte("api record 2"))
+	c.Write(stream)
+	c.Close()
+
+	waitFrames(t, s, 4)
+	s.shutdown()
+
+	for source, want := range map[string]string{
+		"127.0.0.1": "v1 record\n",
+		"web-1.api": "api record\napi record 2\n",
+		"web-1.job": "job record\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, "out", source+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: got %q, want %q", source, data, want)
+		}
+	}
+}
+
+// 确认模式：写入后回确认，重发的帧去重
+func TestLogdAck(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	// 真实的 SocketHandler，全部得到确认
+	addr := s.addrs()[0]
+	h, _ := log.NewSocketHandler(addr.Network(), addr.String())
+	h.SetAck(0, 5*time.Second)
+	for i := 0; i < 100; i++ {
+		h.Write([]byte(fmt.Sprintf("ack record %d", i)))
+	}
+	for i := 0; h.Unacked() != 0; i++ {
+		if i == 500 {
+			t.Fatalf("unacked = %d", h.Unacked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Close()
+
+	// 模拟重连后重发: seq 1、2 发两次
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var stream []byte
+	for _, seq := range []uint64{1, 2, 1, 2, 3} {
+		frame := logframe.AppendV2(nil, &logframe.Header{
+			Hostname: "billing", Flags: logframe.FlagSeq,
+		}, []byte(fmt.Sprintf("seq %d", seq)))
+		logframe.SetFrameSeq(frame, 99, seq)
+		stream = append(stream, frame...)
+	}
+	c.Write(stream)
+
+	// 累计确认到 3
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var last uint64
+	for last != 3 {
+		session, seq, err := logframe.ReadAck(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != 99 || seq < last {
+			t.Fatalf("unexpected ack %d/%d", session, seq)
+		}
+		last = seq
+	}
+
+	st := s.stats()
+	if st.Frames != 103 || st.Duplicates != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	c.Close()
+	s.shutdown()
+
+	data, err := os.ReadFile(filepath.Join(dir, "out", "billing.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "seq 1\nseq 2\nseq 3\n" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestLogdBadFrame(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	defer s.shutdown()
+
+	c, err := net.Dial("tcp", s.addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	frame := make([]byte, 4+2)
+	binary.BigEndian.PutUint32(frame, 2)
+	copy(frame[4:], "ok")
+	c.Write(frame)
+
+	// 超过 max-frame，连接被断开
+	binary.BigEndian.PutUint32(frame, 4096)
+	c.Write(frame[:4])
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect connection closed")
+	}
+
+	st := s.stats()
+	if st.Frames != 1 || st.BadFrames != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestLogdShutdownIdleConn(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	s.cfg.grace = 50 * time.Millisecond
+
+	c, err := net.Dial("tcp", s.addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for s.stats().Active == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	s.shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v", d)
+	}
+}
+
+// 打开的文件数超过 max-outputs 时关闭最久没写的，再写时重新打开
+func TestLogdMaxOutputs(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	s.cfg.maxOutputs = 2
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", s.addrs()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	send := func(c net.Conn, app, body string) {
+		c.Write(logframe.AppendV2(nil, &logframe.Header{Hostname: "web", App: app}, []byte(body)))
+	}
+
+	// c1 一直拿着 web.a 的输出，c2 打开 b、c 时 a 被关闭
+	c1, c2 := dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	send(c1, "a", "a1")
+	waitFrames(t, s, 1)
+	send(c2, "b", "b1")
+	waitFrames(t, s, 2)
+	send(c2, "c", "c1")
+	waitFrames(t, s, 3)
+	send(c1, "a", "a2")
+	waitFrames(t, s, 4)
+
+	s.mu.Lock()
+	n := len(s.outputs)
+	s.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("%d outputs open", n)
+	}
+	if st := s.stats(); st.Sources["web.a"].Frames != 2 || st.WriteErrors != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	c1.Close()
+	c2.Close()
+	s.shutdown()
+
+	for source, want := range map[string]string{
+		"web.a": "a1\na2\n",
+		"web.b": "b1\n",
+		"web.c": "c1\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, "out", source+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: got %q, want %q", source, data, want)
+		}
+	}
+}
+
+// 来源的统计最多保留 4*max-outputs 个，忘掉文件关闭最久的
+func TestLogdSourceCountsLimit(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+	s.cfg.maxOutputs = 1
+
+	c, err := net.Dial("tcp", s.addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 6; i++ {
+		app := fmt.Sprintf("app%d", i)
+		c.Write(logframe.AppendV2(nil, &logframe.Header{Hostname: "web", App: app}, []byte(app)))
+		waitFrames(t, s, int64(i+1))
+	}
+
+	st := s.stats()
+	if len(st.Sources) != 4 {
+		t.Fatalf("%d sources: %+v", len(st.Sources), st.Sources)
+	}
+	for _, source := range []string{"web.app2", "web.app3", "web.app4", "web.app5"} {
+		if st.Sources[source].Frames != 1 {
+			t.Fatalf("%s missing: %+v", source, st.Sources)
+		}
+	}
+	c.Close()
+	s.shutdown()
+}
@@ -0,0 +1,102 @@
+/*
+logd 是 SocketHandler 协议的日志收集服务：
+
+	logd -tcp :9999 -unix /var/run/logd.sock -dir /data/logs -stats 127.0.0.1:9998
+
+	协议: v1 或 v2 帧，一帧一条日志，同一个连接里可以混用，参看 logframe 包。
+	长度为0或超过 -max-frame 的帧认为是非法数据，断开该连接。
+
+	每个来源写到 <dir>/<来源>.log，只写日志内容，v2 的帧头不写。
+	v2 帧的来源为 主机名.app；v1 帧 tcp为对方IP，unix socket为 unix。
+	同时最多打开 -max-outputs 个文件，超过时关闭最久没写的，再来日志时重新打开(追加)。
+
+	带 seq 的帧(SocketHandler.SetAck)写入文件后回累计确认，
+	重发的帧按 session+seq 去重，-dedup-idle 时间内没有新帧的 session 被忘掉。
+	确认只表示已经 write 到文件(在操作系统的页缓存中)，没有 fsync：
+	logd 进程退出或崩溃不会丢已确认的日志，机器掉电或内核崩溃可能会丢。
+	-rotate size 时按大小切割(RotatingFileHandler)，-rotate time 时按时间切割(TimeRotatingFileHandler)。
+
+	-stats 指定时，GET http://<stats>/stats 返回JSON格式的统计；
+	每个来源的统计在文件关闭后还保留，最多保留 4*max-outputs 个来源。
+	收到 SIGINT/SIGTERM 后不再接受新连接，已有连接最多再读 -grace 时间，然后退出。
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+var whenNames = map[string]int8{
+	"second": log.WhenSecond,
+	"minute": log.WhenMinute,
+	"hour":   log.WhenHour,
+	"day":    log.WhenDay,
+}
+
+func main() {
+	var cfg config
+	var when, statsAddr string
+
+	flag.StringVar(&cfg.tcpAddr, "tcp", ":9999", "tcp listen address, empty to disable")
+	flag.StringVar(&cfg.unixPath, "unix", "", "unix socket path, empty to disable")
+	flag.StringVar(&cfg.dir, "dir", "logs", "output directory")
+	flag.StringVar(&cfg.rotate, "rotate", "size", "rotate by size or time")
+	flag.IntVar(&cfg.maxBytes, "max-bytes", 100<<20, "max bytes per file when -rotate size")
+	flag.IntVar(&cfg.backups, "backups", 10, "backup count when -rotate size")
+	flag.StringVar(&when, "when", "day", "second, minute, hour or day when -rotate time")
+	flag.IntVar(&cfg.interval, "interval", 1, "rotate interval in -when units when -rotate time")
+	flag.IntVar(&cfg.maxFrame, "max-frame", 1<<20, "max frame size in bytes")
+	flag.IntVar(&cfg.maxOutputs, "max-outputs", 1024, "max open output files, the least recently written is closed, <=0 for no limit")
+	flag.DurationVar(&cfg.dedupIdle, "dedup-idle", 24*time.Hour, "forget idle ack sessions after this duration")
+	flag.DurationVar(&cfg.grace, "grace", 5*time.Second, "time to drain connections on shutdown")
+	flag.StringVar(&statsAddr, "stats", "", "http address for /stats, empty to disable")
+	flag.Parse()
+
+	w, ok := whenNames[when]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "logd: invalid -when %q\n", when)
+		os.Exit(2)
+	}
+	cfg.when = w
+	if cfg.rotate != "size" && cfg.rotate != "time" {
+		fmt.Fprintf(os.Stderr, "logd: invalid -rotate %q\n", cfg.rotate)
+		os.Exit(2)
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logd: %v\n", err)
+		os.Exit(1)
+	}
+	s.serve()
+	fmt.Fprintf(os.Stderr, "logd: listening on %v\n", s.addrs())
+
+	if statsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/stats", s)
+		go func() {
+			if err := http.ListenAndServe(statsAddr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "logd: stats: %v\n", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	fmt.Fprintf(os.Stderr, "logd: shutting down\n")
+	s.shutdown()
+
+	st := s.stats()
+	fmt.Fprintf(os.Stderr, "logd: connections=%d frames=%d bytes=%d bad_frames=%d\n",
+		st.Connections, st.Frames, st.Bytes, st.BadFrames)
+}
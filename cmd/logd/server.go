@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+type config struct {
+	tcpAddr  string // 为空时不监听tcp
+	unixPath string // 为空时不监听unix socket
+	dir      string // 输出目录，每个来源一个文件: <dir>/<source>.log
+
+	rotate   string // size 或 time
+	maxBytes int    // rotate=size
+	backups  int    // rotate=size
+	when     int8   // rotate=time, log.WhenHour 等
+	interval int    // rotate=time
+
+	maxFrame   int           // 一帧的最大长度，超过认为是非法数据，断开连接
+	maxOutputs int           // 同时打开的输出文件数，超过时关闭最久没写的，<=0 不限制
+	grace      time.Duration // 关闭时等待连接读完的时间
+
+	dedupIdle time.Duration // 确认模式的去重，session 多久没有新帧后忘掉
+}
+
+type sourceStats struct {
+	Frames int64 `json:"frames"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type Stats struct {
+	Connections int64                  `json:"connections"`
+	Active      int64                  `json:"active"`
+	Frames      int64                  `json:"frames"`
+	Bytes       int64                  `json:"bytes"`
+	BadFrames   int64                  `json:"bad_frames"`
+	WriteErrors int64                  `json:"write_errors"`
+	Duplicates  int64                  `json:"duplicates"`
+	Sources     map[string]sourceStats `json:"sources"`
+}
+
+// 一个来源对应一个输出文件。
+// 打开的文件太多时关闭最久没写的，连接中还拿着它的，写的时候发现已关闭再重新取。
+type output struct {
+	name    string // 文件名(不含.log)，也是 server.outputs 的key
+	mu      sync.Mutex
+	h       log.Handler
+	closed  bool  // 用 mu
+	lastUse int64 // 最后一次写的时间，UnixNano
+	counts  *sourceCounts
+}
+
+// 每个来源的统计，输出文件关闭后还保留，
+// 最多保留 maxOutputs*countsPerOutput 个来源，超过时忘掉关闭最久的
+type sourceCounts struct {
+	frames   int64
+	bytes    int64
+	closedAt int64 // 输出文件关闭的时间，UnixNano，用 server.mu
+}
+
+const countsPerOutput = 4
+
+type server struct {
+	cfg config
+
+	listeners []net.Listener
+	closing   int32
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	outputs map[string]*output       // 打开着的输出，按文件名
+	counts  map[string]*sourceCounts // 按文件名
+	conns   map[net.Conn]struct{}
+
+	dedup *logframe.Dedup
+
+	connections int64
+	active      int64
+	frames      int64
+	bytes       int64
+	badFrames   int64
+	writeErrors int64
+	duplicates  int64
+}
+
+// 累计确认最多攒这么多帧
+const ackEvery = 256
+
+// 要回的确认，按收到的顺序，同一个 session 连续的帧合并
+type pendingAck struct {
+	session uint64
+	seq     uint64
+}
+
+func newServer(cfg config) (*server, error) {
+	if cfg.tcpAddr == "" && cfg.unixPath == "" {
+		return nil, fmt.Errorf("no listen address")
+	}
+	if cfg.maxFrame <= 0 {
+		return nil, fmt.Errorf("invalid max frame size %d", cfg.maxFrame)
+	}
+	if err := os.MkdirAll(cfg.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &server{
+		cfg:     cfg,
+		outputs: make(map[string]*output),
+		counts:  make(map[string]*sourceCounts),
+		conns:   make(map[net.Conn]struct{}),
+		dedup:   logframe.NewDedup(cfg.dedupIdle),
+	}
+
+	if cfg.tcpAddr != "" {
+		ln, err := net.Listen("tcp", cfg.tcpAddr)
+		if err != nil {
+			return nil, err
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+	if cfg.unixPath != "" {
+		os.Remove(cfg.unixPath)
+		ln, err := net.Listen("unix", cfg.unixPath)
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+	return s, nil
+}
+
+func (s *server) addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+func (s *server) serve() {
+	for _, ln := range s.listeners {
+		s.wg.Add(1)
+		go s.accept(ln)
+	}
+}
+
+func (s *server) accept(ln net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.closing) == 0 {
+				fmt.Fprintf(os.Stderr, "logd: accept %s: %v\n", ln.Addr(), err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if atomic.LoadInt32(&s.closing) != 0 {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		atomic.AddInt64(&s.connections, 1)
+		go s.handle(c)
+	}
+}
+
+// 来源: v2 帧用帧头中的 主机名.app；
+// v1 帧 tcp 用对方的IP，unix socket 统一为 unix
+func frameSource(f *logframe.Frame, connSource string) string {
+	if f.Version != logframe.Version2 || f.Header.Hostname == "" {
+		return connSource
+	}
+	if f.Header.App == "" {
+		return f.Header.Hostname
+	}
+	return f.Header.Hostname + "." + f.Header.App
+}
+
+func sourceOf(c net.Conn) string {
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return "unix"
+}
+
+func (s *server) handle(c net.Conn) {
+	atomic.AddInt64(&s.active, 1)
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		atomic.AddInt64(&s.active, -1)
+		s.wg.Done()
+	}()
+
+	connSource := sourceOf(c)
+	var (
+		out    *output
+		f      logframe.Frame
+		acks   []pendingAck
+		unsent int
+	)
+
+	d := logframe.NewDecoder(c, s.cfg.maxFrame)
+	for {
+		if err := d.Decode(&f); err != nil {
+			switch err {
+			case logframe.ErrBadFrame, logframe.ErrFrameTooLarge, logframe.ErrBadVersion:
+				// 帧不对时已经无法再分帧，只能断开
+				atomic.AddInt64(&s.badFrames, 1)
+			}
+			if err != io.EOF && atomic.LoadInt32(&s.closing) == 0 {
+				fmt.Fprintf(os.Stderr, "logd: %s: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+
+		hdr := &f.Header
+		var openErr error
+		// 判断重复、写文件、记下已处理在同一个 session 锁内，
+		// 同一个 session 的帧从两个连接同时到达(重连时旧连接还没断)也只写一次
+		dup, err := s.dedup.CheckAndCommit(hdr, func() error {
+			if name := sanitizeSource(frameSource(&f, connSource)); out == nil || name != out.name {
+				o, err := s.output(name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "logd: open output for %s: %v\n", name, err)
+					openErr = err
+					return err
+				}
+				out = o
+			}
+			o, err := s.write(out, f.Body)
+			out = o
+			return err
+		})
+		if dup {
+			// 对方重连后重发的，已经写过了，只回确认
+			atomic.AddInt64(&s.duplicates, 1)
+		} else if openErr != nil || err != nil && hdr.Flags&logframe.FlagSeq != 0 {
+			// 打不开输出，或者带 seq 的帧没写成功：不确认，断开让对方重发
+			return
+		}
+
+		if hdr.Flags&logframe.FlagSeq == 0 {
+			continue
+		}
+		if n := len(acks); n > 0 && acks[n-1].session == hdr.Session {
+			acks[n-1].seq = hdr.Seq
+		} else {
+			acks = append(acks, pendingAck{hdr.Session, hdr.Seq})
+		}
+		// 对方暂时没有更多数据，或者攒够了，回确认
+		if unsent++; d.Buffered() == 0 || unsent >= ackEvery {
+			if err := sendAcks(c, acks); err != nil {
+				if atomic.LoadInt32(&s.closing) == 0 {
+					fmt.Fprintf(os.Stderr, "logd: %s: %v\n", c.RemoteAddr(), err)
+				}
+				return
+			}
+			acks, unsent = acks[:0], 0
+		}
+	}
+}
+
+func sendAcks(c net.Conn, acks []pendingAck) error {
+	var buf []byte
+	for _, a := range acks {
+		buf = logframe.AppendAck(buf, a.session, a.seq)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// 返回实际写的输出：out 已经被关闭时重新取
+func (s *server) write(out *output, record []byte) (*output, error) {
+	if record[len(record)-1] != '\n' {
+		record = append(record, '\n')
+	}
+
+	out.mu.Lock()
+	for out.closed {
+		out.mu.Unlock()
+		o, err := s.output(out.name)
+		if err != nil {
+			atomic.AddInt64(&s.writeErrors, 1)
+			fmt.Fprintf(os.Stderr, "logd: open output for %s: %v\n", out.name, err)
+			return out, err
+		}
+		out = o
+		out.mu.Lock()
+	}
+	atomic.StoreInt64(&out.lastUse, time.Now().UnixNano())
+	_, err := out.h.Write(record)
+	out.mu.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&s.writeErrors, 1)
+		fmt.Fprintf(os.Stderr, "logd: write: %v\n", err)
+		return out, err
+	}
+	atomic.AddInt64(&out.counts.frames, 1)
+	atomic.AddInt64(&out.counts.bytes, int64(len(record)))
+	atomic.AddInt64(&s.frames, 1)
+	atomic.AddInt64(&s.bytes, int64(len(record)))
+	return out, nil
+}
+
+// name 为 sanitizeSource 以后的来源
+func (s *server) output(name string) (*output, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if out, ok := s.outputs[name]; ok {
+		return out, nil
+	}
+	if s.cfg.maxOutputs > 0 && len(s.outputs) >= s.cfg.maxOutputs {
+		s.closeIdleOutput()
+	}
+
+	fileName := filepath.Join(s.cfg.dir, name+".log")
+	var h log.Handler
+	var err error
+	if s.cfg.rotate == "time" {
+		h, err = log.NewTimeRotatingFileHandler(fileName, s.cfg.when, s.cfg.interval)
+	} else {
+		h, err = log.NewRotatingFileHandler(fileName, s.cfg.maxBytes, s.cfg.backups)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	counts := s.counts[name]
+	if counts == nil {
+		if max := s.cfg.maxOutputs * countsPerOutput; max > 0 && len(s.counts) >= max {
+			s.forgetClosedCounts()
+		}
+		counts = new(sourceCounts)
+		s.counts[name] = counts
+	}
+	out := &output{name: name, h: h, lastUse: time.Now().UnixNano(), counts: counts}
+	s.outputs[name] = out
+	return out, nil
+}
+
+// 关闭最久没写的输出。调用时持有 s.mu
+func (s *server) closeIdleOutput() {
+	var idle *output
+	for _, out := range s.outputs {
+		if idle == nil || atomic.LoadInt64(&out.lastUse) < atomic.LoadInt64(&idle.lastUse) {
+			idle = out
+		}
+	}
+	delete(s.outputs, idle.name)
+	idle.counts.closedAt = time.Now().UnixNano()
+
+	idle.mu.Lock()
+	idle.closed = true
+	idle.h.Close()
+	idle.mu.Unlock()
+}
+
+// 忘掉输出文件关闭最久的来源的统计。调用时持有 s.mu
+func (s *server) forgetClosedCounts() {
+	var oldest string
+	var oldestAt int64
+	for name, counts := range s.counts {
+		if _, open := s.outputs[name]; open {
+			continue
+		}
+		if oldest == "" || counts.closedAt < oldestAt {
+			oldest, oldestAt = name, counts.closedAt
+		}
+	}
+	if oldest != "" {
+		delete(s.counts, oldest)
+	}
+}
+
+// IPv6 地址中的 ':' 等不适合做文件名
+func sanitizeSource(source string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, source)
+}
+
+func (s *server) stats() Stats {
+	st := Stats{
+		Connections: atomic.LoadInt64(&s.connections),
+		Active:      atomic.LoadInt64(&s.active),
+		Frames:      atomic.LoadInt64(&s.frames),
+		Bytes:       atomic.LoadInt64(&s.bytes),
+		BadFrames:   atomic.LoadInt64(&s.badFrames),
+		WriteErrors: atomic.LoadInt64(&s.writeErrors),
+		Duplicates:  atomic.LoadInt64(&s.duplicates),
+		Sources:     make(map[string]sourceStats),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, counts := range s.counts {
+		st.Sources[name] = sourceStats{
+			Frames: atomic.LoadInt64(&counts.frames),
+			Bytes:  atomic.LoadInt64(&counts.bytes),
+		}
+	}
+	return st
+}
+
+// GET /stats 返回JSON格式的统计
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.stats())
+}
+
+func (s *server) closeListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// 不再接受新连接；已有的连接最多再读 grace 时间，然后关闭所有输出文件
+func (s *server) shutdown() {
+	s.mu.Lock()
+	atomic.StoreInt32(&s.closing, 1)
+	s.closeListeners()
+	deadline := time.Now().Add(s.cfg.grace)
+	for c := range s.conns {
+		c.SetReadDeadline(deadline)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, out := range s.outputs {
+		out.h.Close()
+	}
+	if s.cfg.unixPath != "" {
+		os.Remove(s.cfg.unixPath)
+	}
+}
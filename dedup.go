@@ -0,0 +1,138 @@
+/*
+重复日志合并：
+
+	logger.SetDedup(10 * time.Second)
+
+	以 (级别, 调用位置, format模板) 为key，窗口内第一条照常输出，
+	之后相同key的日志不再输出，只计数；窗口结束时输出一条汇总：
+	    <第一条的msg> (repeated N times between T1 and T2)
+	汇总日志的级别、调用位置、Fields 都与第一条相同。没有重复时不输出汇总。
+
+	WithField 等派生出来的logger与原logger共用同一个去重表。
+	logger.Close() 或 logger.FlushDedup() 会立即输出还在窗口内的汇总。
+*/
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const dedupTimeFormat = TimeFormatMilli
+
+type dedupKey struct {
+	level  int
+	pc     uintptr
+	format string
+}
+
+type dedupEntry struct {
+	logger *Logger // 第一条日志的logger，汇总时用它的 Fields
+	msg    string
+	first  time.Time
+	last   time.Time
+	count  int // 被合并掉的条数
+	timer  *time.Timer
+}
+
+type deduper struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+}
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window:  window,
+		entries: make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// 返回false表示是窗口内的重复日志，不用输出
+func (d *deduper) allow(l *Logger, level int, pc uintptr, rec *FilterRecord) bool {
+	key := dedupKey{level, pc, rec.format}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.entries[key]; ok {
+		e.count++
+		e.last = now
+		return false
+	}
+
+	e := &dedupEntry{
+		logger: l,
+		msg:    rec.Msg(),
+		first:  now,
+		last:   now,
+	}
+	d.entries[key] = e
+	e.timer = time.AfterFunc(d.window, func() {
+		d.expire(key, e)
+	})
+	return true
+}
+
+func (d *deduper) expire(key dedupKey, e *dedupEntry) {
+	d.mu.Lock()
+	if d.entries[key] != e {
+		d.mu.Unlock() // 已经被 flush 掉了
+		return
+	}
+	delete(d.entries, key)
+	d.mu.Unlock()
+
+	d.summary(key, e)
+}
+
+// 立即结束所有窗口，输出汇总
+func (d *deduper) flush() {
+	d.mu.Lock()
+	entries := d.entries
+	d.entries = make(map[dedupKey]*dedupEntry)
+	d.mu.Unlock()
+
+	for key, e := range entries {
+		e.timer.Stop()
+		d.summary(key, e)
+	}
+}
+
+func (d *deduper) summary(key dedupKey, e *dedupEntry) {
+	d.mu.Lock()
+	count, first, last := e.count, e.first, e.last
+	d.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("%s (repeated %d times between %s and %s)", e.msg, count,
+		first.Format(dedupTimeFormat), last.Format(dedupTimeFormat))
+	e.logger.output(key.level, key.pc, nil, "%s", []interface{}{msg})
+}
+
+// 开启重复日志合并，window<=0 表示关闭。
+// 关闭或更换窗口前，会先输出旧窗口内的汇总。
+func (l *Logger) SetDedup(window time.Duration) {
+	l.FlushDedup()
+	if window <= 0 {
+		l.deduper = nil
+		return
+	}
+	l.deduper = newDeduper(window)
+}
+
+// 立即输出还在窗口内的重复日志汇总
+func (l *Logger) FlushDedup() {
+	if l.deduper != nil {
+		l.deduper.flush()
+	}
+}
+
+func SetDedup(window time.Duration) { std.SetDedup(window) }
+func FlushDedup()                   { std.FlushDedup() }
@@ -0,0 +1,96 @@
+package log4go_test
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	logger, buf, th := newBufferLogger("testDedup")
+	logger.SetDedup(time.Hour)
+
+	db := logger.WithField("dep", "db")
+	for i := 0; i < 100; i++ {
+		db.Error("connect failed: %d", i)
+		logger.Info("other %d", i%2) // 同一行，同一模板
+	}
+	logger.Warn("connect failed: %d", 0) // 级别不同，不合并
+	logger.FlushDedup()
+
+	// 窗口结束后重新计数
+	db.Error("connect failed: %d", 100)
+	logger.Close()
+	th.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "connect failed: 0") ||
+		!strings.Contains(lines[0], `"dep":"db"`) {
+		t.Fatalf("first record: %q", lines[0])
+	}
+
+	var summary string
+	for _, line := range lines[3:5] {
+		if strings.Contains(line, "connect failed") {
+			summary = line
+		}
+	}
+	if !strings.Contains(summary, "connect failed: 0 (repeated 99 times between ") ||
+		!strings.Contains(summary, `"dep":"db"`) {
+		t.Fatalf("summary: %q, output: %q", summary, buf.String())
+	}
+	if !strings.Contains(buf.String(), "other 0 (repeated 99 times") {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	if !strings.Contains(lines[5], "connect failed: 100") ||
+		strings.Contains(lines[5], "repeated") {
+		t.Fatalf("last record: %q", lines[5])
+	}
+}
+
+func TestDedupWindowExpire(t *testing.T) {
+	logger, buf, th := newBufferLogger("testDedupExpire")
+	logger.SetDedup(50 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		logger.Error("timeout")
+	}
+	time.Sleep(200 * time.Millisecond)
+	th.Close()
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "timeout\ntimeout (repeated 2 times between ") {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+type countingStringer struct{ n *int32 }
+
+func (s countingStringer) String() string {
+	atomic.AddInt32(s.n, 1)
+	return "arg"
+}
+
+// 第一条日志只格式化一次，重复的不格式化
+func TestDedupFormatOnce(t *testing.T) {
+	logger, buf, th := newBufferLogger("testDedupFormatOnce")
+	logger.SetDedup(time.Hour)
+
+	var n int32
+	for i := 0; i < 3; i++ {
+		logger.Error("value %v", countingStringer{&n})
+	}
+	if got := atomic.LoadInt32(&n); got != 1 {
+		t.Fatalf("String() called %d times", got)
+	}
+	logger.Close()
+	th.Close()
+
+	if !strings.Contains(buf.String(), "value arg (repeated 2 times") {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
@@ -0,0 +1,73 @@
+/*
+通过 expvar 发布日志统计，引入本包后 /debug/vars 里会多出:
+
+	"log4go": {
+	    "levels":  {"TRACE": 0, "DEBUG": 0, "INFO": 123, ...},   // 各级别产生的日志数
+	    "threads": {"globalLogIOThread": {"writeCnt": 123, "dropCnt": 0,
+	                                      "queueLen": 0, "queueCap": 4096}}
+	}
+*/
+package log4go
+
+import (
+	"expvar"
+	"strconv"
+	"sync/atomic"
+)
+
+// 各级别产生的日志数（过了level检查，交给handler之前）
+var emittedCnt [len(LevelName)]int64
+
+func countEmitted(level int) {
+	if level >= 0 && level < len(emittedCnt) {
+		atomic.AddInt64(&emittedCnt[level], 1)
+	}
+}
+
+type threadVar struct {
+	WriteCnt int64 `json:"writeCnt"`
+	DropCnt  int64 `json:"dropCnt"`
+	QueueLen int   `json:"queueLen"`
+	QueueCap int   `json:"queueCap"`
+}
+
+func expvarThreads() interface{} {
+	vars := make(map[string]threadVar)
+	for _, th := range allIOThreads() {
+		_, write, drop := th.Stat()
+
+		// 重名的IO线程加上序号
+		name := th.name
+		for i := 2; ; i++ {
+			if _, ok := vars[name]; !ok {
+				break
+			}
+			name = th.name + "#" + strconv.Itoa(i)
+		}
+
+		vars[name] = threadVar{
+			WriteCnt: write,
+			DropCnt:  drop,
+			QueueLen: th.queue.len(),
+			QueueCap: th.queue.cap(),
+		}
+	}
+	return vars
+}
+
+func expvarLevels() interface{} {
+	vars := make(map[string]int64, len(LevelName))
+	for i, name := range LevelName {
+		vars[name] = atomic.LoadInt64(&emittedCnt[i])
+	}
+	return vars
+}
+
+func init() {
+	if expvar.Get("log4go") != nil {
+		return
+	}
+	m := expvar.NewMap("log4go")
+	m.Set("threads", expvar.Func(expvarThreads))
+	m.Set("levels", expvar.Func(expvarLevels))
+}
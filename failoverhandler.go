@@ -0,0 +1,126 @@
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//FailoverHandler writes log to the first healthy handler of an ordered list.
+//
+//如: primary 是 SocketHandler，写失败时改写到本地的 RotatingFileHandler；
+//每隔 probeInterval 会重新试一次前面的handler，恢复了就切回去。
+//内部的handlers 由 FailoverHandler 所在的IO线程直接调用 Write()。
+type FailoverHandler struct {
+	handlers    []Handler
+	writeThread iHandleIOWriteThread
+
+	mu            sync.Mutex
+	current       int // 当前在用的handler下标
+	probeInterval time.Duration
+	lastProbe     time.Time
+}
+
+func NewFailoverHandler(probeInterval time.Duration,
+	handlers ...Handler) (*FailoverHandler, error) {
+
+	if len(handlers) == 0 {
+		return nil, fmt.Errorf("failover handler needs at least one handler")
+	}
+	for i, h := range handlers {
+		if h == nil {
+			return nil, fmt.Errorf("failover handler[%d] is nil", i)
+		}
+	}
+
+	h := new(FailoverHandler)
+	h.handlers = handlers
+	h.probeInterval = probeInterval
+	return h, nil
+}
+
+func (h *FailoverHandler) AsyncWrite(fmt Formatter, log *LogInstance) {
+	if h.writeThread != nil {
+		h.writeThread.AsyncWrite(h, fmt, log)
+	} else {
+		globalWriteThread.AsyncWrite(h, fmt, log)
+	}
+}
+
+func (h *FailoverHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.writeThread = th
+}
+
+// 当前在用的handler下标，0 表示 primary
+func (h *FailoverHandler) Active() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current
+}
+
+func (h *FailoverHandler) Write(p []byte) (n int, err error) {
+	return h.write(func(hh Handler, done int) (int, error) {
+		return hh.Write(p[done:])
+	})
+}
+
+// 内部的handler实现了 RecordWriter 时按条写(如 SocketHandler 一条一帧)，否则合并后 Write
+func (h *FailoverHandler) WriteBatch(records [][]byte) (n int, err error) {
+	return h.write(func(hh Handler, done int) (int, error) {
+		if rw, ok := hh.(RecordWriter); ok {
+			return rw.WriteBatch(records[done:])
+		}
+
+		var p []byte
+		for _, r := range records[done:] {
+			p = append(p, r...)
+		}
+		if _, err := hh.Write(p); err != nil {
+			return 0, err
+		}
+		return len(records) - done, nil
+	})
+}
+
+// write 写 done 之后的部分：前面的handler写了一部分才失败时，后面的handler只写剩下的，不重复
+func (h *FailoverHandler) write(
+	write func(hh Handler, done int) (int, error)) (n int, err error) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// 已经切到后面的handler，到了探测时间就从 primary 开始重试
+	start := h.current
+	if start > 0 && time.Since(h.lastProbe) >= h.probeInterval {
+		start = 0
+		h.lastProbe = time.Now()
+	}
+
+	for i := start; i < len(h.handlers); i++ {
+		var k int
+		k, err = write(h.handlers[i], n)
+		n += k
+		if err == nil {
+			if i != h.current {
+				h.current = i
+				h.lastProbe = time.Now()
+			}
+			return
+		}
+	}
+	return
+}
+
+func (h *FailoverHandler) Close() error {
+	if h.writeThread != nil {
+		h.writeThread.Close()
+	}
+
+	var err error
+	for _, hh := range h.handlers {
+		if e := hh.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
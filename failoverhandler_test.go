@@ -0,0 +1,115 @@
+package log4go_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func TestFailoverHandler(t *testing.T) {
+	primary := newFailingHandler(nil, errPermanent, errPermanent)
+	buf := new(bytes.Buffer)
+	fallback, _ := log.NewStreamHandler(buf)
+
+	h, err := log.NewFailoverHandler(50*time.Millisecond, primary, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// primary 失败，写到 fallback
+	if _, err := h.Write([]byte("1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if h.Active() != 1 {
+		t.Fatalf("expect failover to fallback, active=%d", h.Active())
+	}
+
+	// 探测时间之前，不再试 primary
+	h.Write([]byte("2\n"))
+	if calls, _ := primary.stat(); calls != 1 {
+		t.Fatalf("primary should not be probed yet, calls=%d", calls)
+	}
+
+	// 探测时 primary 仍失败，继续用 fallback
+	time.Sleep(60 * time.Millisecond)
+	h.Write([]byte("3\n"))
+	if calls, _ := primary.stat(); calls != 2 || h.Active() != 1 {
+		t.Fatalf("calls=%d active=%d", calls, h.Active())
+	}
+
+	// primary 恢复后切回去
+	time.Sleep(60 * time.Millisecond)
+	h.Write([]byte("4\n"))
+	if h.Active() != 0 {
+		t.Fatalf("expect switch back to primary, active=%d", h.Active())
+	}
+	if _, data := primary.stat(); data != "4\n" {
+		t.Fatalf("primary data=%q", data)
+	}
+	if buf.String() != "1\n2\n3\n" {
+		t.Fatalf("fallback data=%q", buf.String())
+	}
+}
+
+func TestFailoverHandlerAllFailed(t *testing.T) {
+	a := newFailingHandler(nil, errPermanent)
+	b := newFailingHandler(nil, errPermanent)
+	h, _ := log.NewFailoverHandler(time.Second, a, b)
+
+	if _, err := h.Write([]byte("x")); err != errPermanent {
+		t.Fatalf("expect error when all handlers fail, got %v", err)
+	}
+}
+
+func TestFailoverHandlerAsync(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testFailover", 128)
+	primary := newFailingHandler(th, errPermanent)
+	buf := new(bytes.Buffer)
+	fallback, _ := log.NewStreamHandler(buf)
+
+	h, _ := log.NewFailoverHandler(time.Minute, primary, fallback)
+	h.SetWriteIOThread(th)
+
+	logger := log.NewLogger(h, 0)
+	logger.Info("hello failover")
+	h.Close()
+
+	if buf.String() != "hello failover\n" {
+		t.Fatalf("fallback data=%q", buf.String())
+	}
+}
+
+// 写了 limit 条以后失败
+type partialBatchHandler struct {
+	*log.NullHandler
+	limit   int
+	records []string
+}
+
+func (h *partialBatchHandler) WriteBatch(records [][]byte) (int, error) {
+	for i, r := range records {
+		if len(h.records) >= h.limit {
+			return i, errPermanent
+		}
+		h.records = append(h.records, string(r))
+	}
+	return len(records), nil
+}
+
+// primary 写了一部分才失败，fallback 只写剩下的
+func TestFailoverHandlerPartialBatch(t *testing.T) {
+	primary := &partialBatchHandler{NullHandler: new(log.NullHandler), limit: 2}
+	fallback := &partialBatchHandler{NullHandler: new(log.NullHandler), limit: 100}
+	h, _ := log.NewFailoverHandler(time.Minute, primary, fallback)
+
+	n, err := h.WriteBatch([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+	if n != 4 || err != nil {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if fmt.Sprint(primary.records) != "[a b]" || fmt.Sprint(fallback.records) != "[c d]" {
+		t.Fatalf("primary=%v fallback=%v", primary.records, fallback.records)
+	}
+}
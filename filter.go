@@ -0,0 +1,175 @@
+/*
+日志过滤：
+
+	Logger.AddFilter(f)           对此logger的所有日志生效
+	NewFilterHandler(h, f...)     只对某个handler生效，可以用来按条件路由到不同handler
+
+	过滤在 Logger.Output 中、取 LogInstance 与入IO队列之前进行，
+	被过滤掉的日志不会占用 LogInstenceBuffer 与IO队列。
+	注意：有Filter时，msg 在调用方格式化（用到 FilterRecord.Msg() 时）。
+*/
+package log4go
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// 过滤时看到的日志信息
+type FilterRecord struct {
+	Logger string // GetLogger(name) 的name，std logger 为 "root"
+	Level  int
+	Fields Fields
+
+	format  string
+	args    []interface{}
+	msg     string
+	msgDone bool
+
+	// 第i个handler(i<64)被它的Filter拒绝了
+	denied uint64
+}
+
+// 格式化后的msg，第一次调用时才格式化
+func (r *FilterRecord) Msg() string {
+	if !r.msgDone {
+		r.msg = truncateMsg(fmt.Sprintf(r.format, r.args...))
+		r.msgDone = true
+	}
+	return r.msg
+}
+
+type Filter interface {
+	// 返回false时，丢弃这条日志
+	Allow(r *FilterRecord) bool
+}
+
+type FilterFunc func(r *FilterRecord) bool
+
+func (f FilterFunc) Allow(r *FilterRecord) bool {
+	return f(r)
+}
+
+func (l *Logger) AddFilter(f Filter) {
+	l.filters = append(l.filters, f)
+}
+
+func AddFilter(f Filter) { std.AddFilter(f) }
+
+// 所有Filter都允许，且至少有一个handler允许时返回true
+func (l *Logger) filter(r *FilterRecord) bool {
+	for _, f := range l.filters {
+		if !f.Allow(r) {
+			return false
+		}
+	}
+
+	allowed := false
+	for i, h := range l.handlers {
+		if fh, ok := h.(*FilterHandler); ok && !fh.allow(r) {
+			if i < 64 {
+				r.denied |= 1 << uint(i)
+			}
+			continue
+		}
+		if h != nil {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// 第i个handler是否接收这条日志
+func (r *FilterRecord) handlerAllowed(i int, h Handler) bool {
+	if r == nil {
+		return true
+	}
+	if i < 64 {
+		return r.denied&(1<<uint(i)) == 0
+	}
+	fh, ok := h.(*FilterHandler)
+	return !ok || fh.allow(r)
+}
+
+func hasFilterHandler(handlers []Handler) bool {
+	for _, h := range handlers {
+		if _, ok := h.(*FilterHandler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//----------- 只对某个handler生效的Filter ------------------------
+
+// FilterHandler wraps a Handler, only logs allowed by all filters are written to it.
+type FilterHandler struct {
+	Handler
+	filters []Filter
+}
+
+func NewFilterHandler(h Handler, filters ...Filter) *FilterHandler {
+	return &FilterHandler{Handler: h, filters: filters}
+}
+
+func (h *FilterHandler) allow(r *FilterRecord) bool {
+	for _, f := range h.filters {
+		if !f.Allow(r) {
+			return false
+		}
+	}
+	return true
+}
+
+//----------- 内置的Filter ------------------------
+
+// 只允许 min <= level <= max 的日志
+type LevelRangeFilter struct {
+	Min int
+	Max int
+}
+
+func NewLevelRangeFilter(min, max int) *LevelRangeFilter {
+	return &LevelRangeFilter{Min: min, Max: max}
+}
+
+func (f *LevelRangeFilter) Allow(r *FilterRecord) bool {
+	return r.Level >= f.Min && r.Level <= f.Max
+}
+
+// exclude 为true时丢弃msg匹配的日志，否则只保留匹配的日志
+type RegexFilter struct {
+	re      *regexp.Regexp
+	exclude bool
+}
+
+func NewRegexFilter(expr string, exclude bool) (*RegexFilter, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexFilter{re: re, exclude: exclude}, nil
+}
+
+func (f *RegexFilter) Allow(r *FilterRecord) bool {
+	return f.re.MatchString(r.Msg()) != f.exclude
+}
+
+// exclude 为true时丢弃 Fields[key]==value 的日志，否则只保留相等的日志
+// 如不输出健康检查的访问日志：NewFieldFilter("path", "/health", true)
+type FieldFilter struct {
+	key     string
+	value   interface{}
+	exclude bool
+}
+
+func NewFieldFilter(key string, value interface{}, exclude bool) *FieldFilter {
+	return &FieldFilter{key: key, value: value, exclude: exclude}
+}
+
+func (f *FieldFilter) Allow(r *FilterRecord) bool {
+	v, ok := r.Fields[f.key]
+	equal := ok && reflect.DeepEqual(v, f.value)
+	return equal != f.exclude
+}
@@ -0,0 +1,108 @@
+package log4go_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func newBufferLogger(name string) (*log.Logger, *bytes.Buffer, *log.HandleIOWriteThread) {
+	buf := new(bytes.Buffer)
+	h, _ := log.NewStreamHandler(buf)
+	th := log.NewHandleIOWriteThread(name, 1024)
+	h.SetWriteIOThread(th)
+	logger := log.NewLogger(h, 0)
+	logger.SetLevel(log.LevelTrace)
+	return logger, buf, th
+}
+
+func TestLoggerFilters(t *testing.T) {
+	logger, buf, th := newBufferLogger("testFilters")
+
+	re, err := log.NewRegexFilter("^health", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.AddFilter(log.NewLevelRangeFilter(log.LevelDebug, log.LevelError))
+	logger.AddFilter(re)
+	logger.AddFilter(log.FilterFunc(func(r *log.FilterRecord) bool {
+		return !strings.Contains(r.Msg(), "secret")
+	}))
+
+	logger.Trace("trace dropped")
+	logger.Debug("debug kept")
+	logger.Info("health check dropped")
+	logger.Info("a secret dropped")
+	logger.Fatal("fatal dropped")
+
+	access := logger.WithField("path", "/health")
+	access.AddFilter(log.NewFieldFilter("path", "/health", true))
+	access.Info("access dropped")
+	logger.WithField("path", "/api").Info("api kept")
+	th.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[0] != "debug kept" ||
+		!strings.Contains(lines[1], "api kept") {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+
+	// 被过滤的日志不会进入IO队列
+	if _, write, drop := th.Stat(); write != 2 || drop != 0 {
+		t.Fatalf("write=%d drop=%d", write, drop)
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testFilterHandler", 1024)
+
+	errBuf, infoBuf := new(bytes.Buffer), new(bytes.Buffer)
+	errH, _ := log.NewStreamHandler(errBuf)
+	infoH, _ := log.NewStreamHandler(infoBuf)
+	errH.SetWriteIOThread(th)
+	infoH.SetWriteIOThread(th)
+
+	logger := log.NewLogger(log.NewFilterHandler(errH,
+		log.NewLevelRangeFilter(log.LevelError, log.LevelBuss)), 0)
+	logger.AppendHandler(log.NewFilterHandler(infoH,
+		log.NewLevelRangeFilter(log.LevelInfo, log.LevelWarn)))
+
+	logger.Info("info")
+	logger.Error("error")
+	logger.Debug("debug, below logger level")
+	th.Close()
+
+	if errBuf.String() != "error\n" || infoBuf.String() != "info\n" {
+		t.Fatalf("err=%q info=%q", errBuf.String(), infoBuf.String())
+	}
+	if _, write, _ := th.Stat(); write != 2 {
+		t.Fatalf("write=%d", write)
+	}
+}
+
+func TestFilterByLoggerName(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h, _ := log.NewStreamHandler(buf)
+	th := log.NewHandleIOWriteThread("testFilterName", 1024)
+	h.SetWriteIOThread(th)
+
+	onlyDB := log.FilterFunc(func(r *log.FilterRecord) bool {
+		return r.Logger == "testFilterName.db"
+	})
+	unnamed := log.NewLogger(h, 0)
+	unnamed.AddFilter(onlyDB)
+	db := log.GetLogger("testFilterName.db")
+	db.SetHandler(h)
+	db.AddFilter(onlyDB)
+
+	unnamed.Info("unnamed dropped")
+	db.Info("db kept")
+	th.Close()
+
+	out := buf.String()
+	if !strings.Contains(out, "db kept") || strings.Contains(out, "unnamed dropped") {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
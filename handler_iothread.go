@@ -35,6 +35,7 @@ type hdlrWriter struct {
 	Handler Handler
 	Fmt     Formatter
 	Log     *LogInstance
+	Enqueue int64 // 入队时间 UnixNano
 }
 
 type HandleIOWriteThread struct {
@@ -42,38 +43,59 @@ type HandleIOWriteThread struct {
 	clsoed bool
 	quit   chan bool
 
-	handlerWriterChan   chan *hdlrWriter // 一个IO线程处理多个handler的写
-	handlerWriterBuffer *sync.Pool
+	queue hdlrWriterQueue // 一个IO线程处理多个handler的写
 
 	writeBuffer *bytes.Buffer
 
 	dropCnt  int64
 	writeCnt int64
+	metrics  ioThreadMetrics
+
+	// writeBuffer 中每条日志的入队时间，写出后统计延迟
+	pendingEnqueue []int64
+
+	// writeBuffer 中每条日志的结束位置，按条写时用，参看 handler_iothread_record.go
+	recordEnds []int
+	records    [][]byte
 
 	wg                  sync.WaitGroup
 	dropLogCallbackFunc DropLogCallbackFunc
+
+	// 写出错处理，参看 handler_iothread_retry.go
+	writeErrorCallbackFunc WriteErrorCallbackFunc
+	maxRetries             int
+	retryBackoff           time.Duration
+	breakerFailures        int
+	breakerCooldown        time.Duration
+	healthMu               sync.Mutex
+	health                 map[Handler]*handlerHealth
 }
 
 const _8k = 8192
 const _4k = 4096 //假定文件系统block size=4k
 
 func NewHandleIOWriteThread(name string, chanLength int) *HandleIOWriteThread {
+	return NewHandleIOWriteThreadWithQueue(name, chanLength, QueueTypeChan)
+}
+
+// queueType: QueueTypeChan 或 QueueTypeRing，
+// QueueTypeRing 的长度会向上取整为2的幂。
+func NewHandleIOWriteThreadWithQueue(name string, length int,
+	queueType int) *HandleIOWriteThread {
+
 	self := new(HandleIOWriteThread)
 
 	self.name = name
 	self.quit = make(chan bool, 10)
-	self.handlerWriterChan = make(chan *hdlrWriter, chanLength)
-
-	self.handlerWriterBuffer = &sync.Pool{
-		New: func() interface{} {
-			return new(hdlrWriter)
-		},
-	}
+	self.queue = newHdlrWriterQueue(queueType, length)
 
 	// use 8k buffer in memory, linux filesys block was 4k
-	self.writeBuffer = bytes.NewBuffer(make([]byte, 1024*8))
+	self.writeBuffer = bytes.NewBuffer(make([]byte, 0, _8k))
 
+	self.wg.Add(1)
 	go self.run()
+
+	registerIOThread(self)
 	return self
 }
 
@@ -85,39 +107,41 @@ func (self *HandleIOWriteThread) AsyncWrite(
 	h Handler, fmt Formatter, log *LogInstance) {
 
 	if h == nil || fmt == nil {
+		log.Release()
 		return
 	}
 
-	hw := self.handlerWriterBuffer.Get().(*hdlrWriter)
-	hw.Handler = h
-	hw.Fmt = fmt
-	hw.Log = log
-
-	select {
-	case self.handlerWriterChan <- hw:
-		return
-	default:
-		// TODO: 当handlerWriterChan满了时，只能丢弃日志，
+	if self.queue.push(h, fmt, log, time.Now().UnixNano()) {
+		self.metrics.observeQueueLen(self.queue.len())
+	} else {
+		// TODO: 当队列满了时，只能丢弃日志，
 		//    问题在于怎么通知开发人员，丢日志了，
 		//    初步想法可以通过普罗米修斯这类的数据收集，进行告警。
 		//    丢日志原因有很多，可能硬盘介质写速度太慢，或满了。
 		//    如果是网络发送，也会有慢的时候。
-		atomic.AddInt64(&self.dropCnt, 1)
-		if self.dropLogCallbackFunc != nil {
-			self.dropLogCallbackFunc(log, self.dropCnt)
-		}
+		self.drop(log)
 		// TODO：通知开发人员。
 	}
 }
 
+func (self *HandleIOWriteThread) drop(log *LogInstance) {
+	sum := atomic.AddInt64(&self.dropCnt, 1)
+	if self.dropLogCallbackFunc != nil {
+		log.resolve()
+		log.redact()
+		self.dropLogCallbackFunc(log, sum)
+	}
+	log.Release()
+}
+
 func (self *HandleIOWriteThread) doFormat(hw *hdlrWriter,
-	buff *bytes.Buffer) {
+	buff *bytes.Buffer) (ok bool) {
 
 	defer func() {
-		LogInstenceBuffer.Put(hw.Log)
-		self.handlerWriterBuffer.Put(hw)
+		hw.Log.Release()
 
 		if err := recover(); err != nil {
+			atomic.AddInt64(&self.metrics.formatErrors, 1)
 			fmt.Fprintf(os.Stderr, "\n[%s] PKG[wps.cn/log] err: %v\n",
 				self.name, err)
 		}
@@ -127,78 +151,112 @@ func (self *HandleIOWriteThread) doFormat(hw *hdlrWriter,
 		hw.Fmt = globalTxtLineFormatter
 	}
 
+	hw.Log.resolve()
+	hw.Log.redact()
 	if _, e := hw.Fmt.Format(buff, hw.Log); e != nil {
 		//TODO: format出错，怎么办？
+		atomic.AddInt64(&self.metrics.formatErrors, 1)
 		if hw.Fmt != globalTxtLineFormatter {
 			// TxtLineFormatter 不会返回出错
-			hw.Fmt.Format(buff, hw.Log)
+			globalTxtLineFormatter.Format(buff, hw.Log)
 		} else {
 			os.Stderr.WriteString(e.Error())
-			self.dropCnt += 1
-			return
+			atomic.AddInt64(&self.dropCnt, 1)
+			return false
 		}
 	}
 
-	self.writeCnt += 1
+	atomic.AddInt64(&self.writeCnt, 1)
+	self.metrics.observeLevel(hw.Log.LevelNo)
+	self.pendingEnqueue = append(self.pendingEnqueue, hw.Enqueue)
+	self.recordEnds = append(self.recordEnds, buff.Len())
+	return true
+}
+
+// 把 writeBuffer 写到handler
+func (self *HandleIOWriteThread) flush(h Handler) {
+	pBuff := self.writeBuffer
+	if pBuff.Len() == 0 {
+		return
+	}
+
+	var n int
+	var err error
+	if rw, ok := h.(RecordWriter); ok {
+		n, err = self.writeRecordsWithRetry(rw, pBuff.Bytes())
+	} else {
+		n, err = self.writeWithRetry(h, pBuff.Bytes())
+	}
+	self.metrics.observeWrite(h, n, err, self.pendingEnqueue)
+	self.writeDone(h, err)
+
+	self.pendingEnqueue = self.pendingEnqueue[:0]
+	self.recordEnds = self.recordEnds[:0]
+	pBuff.Reset()
 }
 
 func (self *HandleIOWriteThread) doWrite(hw *hdlrWriter) {
 	pBuff := self.writeBuffer //default 8k
-	self.doFormat(hw, pBuff)
-	if pBuff.Len() >= _4k {
-		hw.Handler.Write(pBuff.Bytes())
-		pBuff.Reset()
-	}
 
-	for len(self.handlerWriterChan) > 0 {
-		hw = <-self.handlerWriterChan
-		self.doFormat(hw, pBuff)
+	// 同一个IO线程可能服务多个handler，handler变化时要先把buffer写出去，
+	// 否则会把A handler的日志写到B handler中。
+	h := hw.Handler
+	for {
+		if hw.Handler != h {
+			self.flush(h)
+			h = hw.Handler
+		}
+
+		if self.breakerOpen(h) {
+			// 熔断中的handler，不写直接丢弃
+			self.drop(hw.Log)
+		} else if start := pBuff.Len(); !self.doFormat(hw, pBuff) {
+			// 格式化失败时去掉写了一半的内容
+			pBuff.Truncate(start)
+		}
+
 		if pBuff.Len() >= _4k {
-			hw.Handler.Write(pBuff.Bytes())
-			pBuff.Reset()
+			self.flush(h)
 		}
-	}
 
-	if pBuff.Len() > 0 {
-		hw.Handler.Write(pBuff.Bytes())
-		pBuff.Reset()
+		if !self.queue.tryPop(hw) {
+			break
+		}
 	}
+
+	self.flush(h)
 }
 
 func (self *HandleIOWriteThread) run() {
-	self.wg.Add(1)
 	defer self.wg.Done()
-	stop := false
-	var hw *hdlrWriter
-	var quitStartTime time.Time
-	for {
-		select {
-		case hw = <-self.handlerWriterChan:
-			self.doWrite(hw)
-		case <-self.quit:
-			stop = true
-			quitStartTime = time.Now()
-		}
-		if stop {
-			if len(self.handlerWriterChan) == 0 {
-				return
-			}
-			if time.Since(quitStartTime) >= MAX_WAIT_TIME_ON_EXIT {
-				remain := len(self.handlerWriterChan)
-				self.dropCnt += int64(remain)
-
-				if remain > 0 {
-					fmt.Fprintf(os.Stdout,
-						"%s, but remain logs[%v] do not flush yet.",
-						"log package was Closed()", remain)
-
-					if self.dropLogCallbackFunc != nil {
-						hw = <-self.handlerWriterChan
-						self.dropLogCallbackFunc(hw.Log, self.dropCnt)
-					}
+
+	var hw hdlrWriter
+	for self.queue.pop(self.quit, &hw) {
+		self.doWrite(&hw)
+	}
+
+	// Close() 后，把队列中剩下的日志写完，最多等 MAX_WAIT_TIME_ON_EXIT
+	quitStartTime := time.Now()
+	for self.queue.tryPop(&hw) {
+		self.doWrite(&hw)
+
+		if time.Since(quitStartTime) >= MAX_WAIT_TIME_ON_EXIT {
+			remain := self.queue.len()
+			sum := atomic.AddInt64(&self.dropCnt, int64(remain))
+
+			if remain > 0 {
+				fmt.Fprintf(os.Stdout,
+					"%s, but remain logs[%v] do not flush yet.",
+					"log package was Closed()", remain)
+
+				if self.dropLogCallbackFunc != nil &&
+					self.queue.tryPop(&hw) {
+					hw.Log.resolve()
+					hw.Log.redact()
+					self.dropLogCallbackFunc(hw.Log, sum)
 				}
-				return
 			}
+			return
 		}
 	}
 }
@@ -209,6 +267,7 @@ func (self *HandleIOWriteThread) Close() {
 		return
 	}
 	self.clsoed = true
+	unregisterIOThread(self)
 
 	select {
 	case self.quit <- true:
@@ -219,7 +278,7 @@ func (self *HandleIOWriteThread) Close() {
 }
 
 func (self *HandleIOWriteThread) Stat() (name string, writeSum int64, dropSum int64) {
-	return self.name, self.writeCnt, self.dropCnt
+	return self.name, atomic.LoadInt64(&self.writeCnt), atomic.LoadInt64(&self.dropCnt)
 }
 
 // 测试用函数
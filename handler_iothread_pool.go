@@ -0,0 +1,116 @@
+/*
+多个IO线程组成的线程池：
+  单个IO线程在高压下（约17万条/s）丢日志比较多，
+  HandleIOWritePool 启动N个 HandleIOWriteThread，
+  每个Handler固定分配给其中一个线程(分片)，
+  这样同一个Handler的日志顺序不变，不同Handler可以并行格式化和写IO。
+
+  用法：
+    pool := log.NewHandleIOWritePool("my-pool", 4, 8192)
+    hdlr.SetWriteIOThread(pool)
+*/
+package log4go
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HandleIOWritePool struct {
+	name    string
+	workers []*HandleIOWriteThread
+
+	// Handler => worker下标，第一次见到某个Handler时轮流分配。
+	// Handler 必需是可比较类型(一般是指针)。
+	shards sync.Map
+	next   uint32
+}
+
+func NewHandleIOWritePool(name string, workerNum int, chanLength int) *HandleIOWritePool {
+	if workerNum <= 0 {
+		panic("worker number must >0.")
+	}
+
+	self := new(HandleIOWritePool)
+	self.name = name
+	self.workers = make([]*HandleIOWriteThread, workerNum)
+	for i := range self.workers {
+		self.workers[i] = NewHandleIOWriteThread(
+			fmt.Sprintf("%s-%d", name, i), chanLength)
+	}
+	return self
+}
+
+func (self *HandleIOWritePool) worker(h Handler) *HandleIOWriteThread {
+	if idx, ok := self.shards.Load(h); ok {
+		return self.workers[idx.(int)]
+	}
+
+	n := atomic.AddUint32(&self.next, 1) - 1
+	idx, _ := self.shards.LoadOrStore(h, int(n%uint32(len(self.workers))))
+	return self.workers[idx.(int)]
+}
+
+func (self *HandleIOWritePool) AsyncWrite(
+	h Handler, fmt Formatter, log *LogInstance) {
+
+	if h == nil || fmt == nil {
+		log.Release()
+		return
+	}
+	self.worker(h).AsyncWrite(h, fmt, log)
+}
+
+func (self *HandleIOWritePool) SetDropCallback(f DropLogCallbackFunc) {
+	for _, w := range self.workers {
+		w.SetDropCallback(f)
+	}
+}
+
+// 以下设置对每个worker生效，参看 handler_iothread_retry.go
+func (self *HandleIOWritePool) SetWriteErrorCallback(f WriteErrorCallbackFunc) {
+	for _, w := range self.workers {
+		w.SetWriteErrorCallback(f)
+	}
+}
+
+func (self *HandleIOWritePool) SetWriteRetry(maxRetries int, backoff time.Duration) {
+	for _, w := range self.workers {
+		w.SetWriteRetry(maxRetries, backoff)
+	}
+}
+
+func (self *HandleIOWritePool) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	for _, w := range self.workers {
+		w.SetCircuitBreaker(failures, cooldown)
+	}
+}
+
+// handler是否可用(没有熔断)
+func (self *HandleIOWritePool) HandlerHealthy(h Handler) bool {
+	return self.worker(h).HandlerHealthy(h)
+}
+
+func (self *HandleIOWritePool) Close() {
+	var wg sync.WaitGroup
+	for _, w := range self.workers {
+		wg.Add(1)
+		go func(w *HandleIOWriteThread) {
+			defer wg.Done()
+			w.Close()
+		}(w)
+	}
+	wg.Wait()
+}
+
+// 所有worker的写入与丢弃数之和
+func (self *HandleIOWritePool) Stat() (name string, writeSum int64, dropSum int64) {
+	for _, w := range self.workers {
+		_, write, drop := w.Stat()
+		writeSum += write
+		dropSum += drop
+	}
+	return self.name, writeSum, dropSum
+}
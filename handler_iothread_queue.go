@@ -0,0 +1,219 @@
+/*
+IO线程的待写队列：
+  QueueTypeChan -- 默认实现，带缓冲的chan，每条日志从sync.Pool取一个hdlrWriter。
+  QueueTypeRing -- 多生产者单消费者(MPSC)的无锁环形队列，槽位预先分配好，
+                   入队只有一次CAS，没有chan的锁竞争，也不需要sync.Pool。
+*/
+package log4go
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	QueueTypeChan = iota
+	QueueTypeRing
+)
+
+type hdlrWriterQueue interface {
+	// 队列满时返回false，不阻塞
+	push(h Handler, fmt Formatter, log *LogInstance, enqueue int64) bool
+
+	// 阻塞直到取到一条，quit有数据时返回false
+	pop(quit <-chan bool, hw *hdlrWriter) bool
+
+	// 不阻塞，队列空时返回false
+	tryPop(hw *hdlrWriter) bool
+
+	len() int
+	cap() int
+}
+
+func newHdlrWriterQueue(queueType int, length int) hdlrWriterQueue {
+	switch queueType {
+	case QueueTypeChan:
+		return newChanQueue(length)
+	case QueueTypeRing:
+		return newRingQueue(length)
+	default:
+		panic("invalid queue type.")
+	}
+}
+
+//----------- chan 实现 ------------------------
+
+type chanQueue struct {
+	ch   chan *hdlrWriter
+	pool *sync.Pool
+}
+
+func newChanQueue(length int) *chanQueue {
+	return &chanQueue{
+		ch: make(chan *hdlrWriter, length),
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return new(hdlrWriter)
+			},
+		},
+	}
+}
+
+func (q *chanQueue) push(h Handler, fmt Formatter, log *LogInstance,
+	enqueue int64) bool {
+
+	hw := q.pool.Get().(*hdlrWriter)
+	hw.Handler = h
+	hw.Fmt = fmt
+	hw.Log = log
+	hw.Enqueue = enqueue
+
+	select {
+	case q.ch <- hw:
+		return true
+	default:
+		*hw = hdlrWriter{}
+		q.pool.Put(hw)
+		return false
+	}
+}
+
+func (q *chanQueue) take(p *hdlrWriter, hw *hdlrWriter) {
+	*hw = *p
+	*p = hdlrWriter{}
+	q.pool.Put(p)
+}
+
+func (q *chanQueue) pop(quit <-chan bool, hw *hdlrWriter) bool {
+	select {
+	case p := <-q.ch:
+		q.take(p, hw)
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+func (q *chanQueue) tryPop(hw *hdlrWriter) bool {
+	select {
+	case p := <-q.ch:
+		q.take(p, hw)
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *chanQueue) len() int { return len(q.ch) }
+func (q *chanQueue) cap() int { return cap(q.ch) }
+
+//----------- 环形队列实现 ------------------------
+// 参考 Dmitry Vyukov 的 bounded MPMC queue，消费者只有IO线程一个。
+// 每个槽位的seq表示它的状态：
+//   seq == pos       空闲，生产者可写
+//   seq == pos+1     已写好，消费者可读
+//   seq == pos+size  已读完，留给下一圈的生产者
+
+type ringSlot struct {
+	seq uint64
+	hw  hdlrWriter
+}
+
+type cacheLinePad [64]byte
+
+type ringQueue struct {
+	_    cacheLinePad
+	tail uint64 // 生产者CAS
+	_    cacheLinePad
+	head uint64 // 只有消费者写
+	_    cacheLinePad
+
+	mask  uint64
+	slots []ringSlot
+
+	// 队列由空变非空时唤醒IO线程，容量为1，满了就不用再发。
+	notify chan struct{}
+}
+
+func newRingQueue(length int) *ringQueue {
+	size := uint64(2)
+	for size < uint64(length) {
+		size <<= 1
+	}
+
+	q := &ringQueue{
+		mask:   size - 1,
+		slots:  make([]ringSlot, size),
+		notify: make(chan struct{}, 1),
+	}
+	for i := range q.slots {
+		q.slots[i].seq = uint64(i)
+	}
+	return q
+}
+
+func (q *ringQueue) push(h Handler, fmt Formatter, log *LogInstance,
+	enqueue int64) bool {
+
+	for {
+		pos := atomic.LoadUint64(&q.tail)
+		slot := &q.slots[pos&q.mask]
+		seq := atomic.LoadUint64(&slot.seq)
+
+		if dif := int64(seq) - int64(pos); dif == 0 {
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				slot.hw.Handler = h
+				slot.hw.Fmt = fmt
+				slot.hw.Log = log
+				slot.hw.Enqueue = enqueue
+				atomic.StoreUint64(&slot.seq, pos+1)
+
+				select {
+				case q.notify <- struct{}{}:
+				default:
+				}
+				return true
+			}
+		} else if dif < 0 {
+			return false // 满了
+		}
+		// dif > 0: 别的生产者抢先了，重试
+	}
+}
+
+func (q *ringQueue) tryPop(hw *hdlrWriter) bool {
+	pos := q.head
+	slot := &q.slots[pos&q.mask]
+	if atomic.LoadUint64(&slot.seq) != pos+1 {
+		return false
+	}
+
+	*hw = slot.hw
+	slot.hw = hdlrWriter{}
+	atomic.StoreUint64(&slot.seq, pos+q.mask+1)
+	atomic.StoreUint64(&q.head, pos+1)
+	return true
+}
+
+func (q *ringQueue) pop(quit <-chan bool, hw *hdlrWriter) bool {
+	for {
+		if q.tryPop(hw) {
+			return true
+		}
+		select {
+		case <-q.notify:
+		case <-quit:
+			return false
+		}
+	}
+}
+
+func (q *ringQueue) len() int {
+	n := int64(atomic.LoadUint64(&q.tail)) - int64(atomic.LoadUint64(&q.head))
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+func (q *ringQueue) cap() int { return len(q.slots) }
@@ -0,0 +1,58 @@
+package log4go
+
+import (
+	"time"
+)
+
+// RecordWriter 是Handler可选实现的接口。
+//
+// IO线程默认把多条格式化好的日志合并到一个buffer(最多约4KB)，调用一次 Handler.Write；
+// handler 实现了 RecordWriter 时，改为把这一批日志按条交给 WriteBatch，
+// records[i] 是一条完整的日志。用于每条日志要单独成帧/成包的协议，
+// 如 SocketHandler 的一条一帧、syslog 的UDP报文。
+//
+// records 引用的是IO线程的buffer，WriteBatch 返回后会被复用，需要保留的话要复制。
+// 返回完整写出的条数；出错时 n 之后的日志会按 SetWriteRetry 的设置重试。
+type RecordWriter interface {
+	WriteBatch(records [][]byte) (n int, err error)
+}
+
+// 返回写出的字节数
+func (self *HandleIOWriteThread) writeRecordsWithRetry(rw RecordWriter,
+	p []byte) (written int, err error) {
+
+	records := self.records[:0]
+	start := 0
+	for _, end := range self.recordEnds {
+		records = append(records, p[start:end])
+		start = end
+	}
+	if start < len(p) {
+		records = append(records, p[start:])
+	}
+
+	backoff := self.retryBackoff
+	for i, done := 0, 0; ; i++ {
+		var m int
+		m, err = rw.WriteBatch(records[done:])
+		for _, r := range records[done : done+m] {
+			written += len(r)
+		}
+		done += m
+
+		if err == nil || i >= self.maxRetries || !isTransientError(err) {
+			break
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MAX_RETRY_BACKOFF {
+			backoff = MAX_RETRY_BACKOFF
+		}
+	}
+
+	for i := range records {
+		records[i] = nil
+	}
+	self.records = records[:0]
+	return
+}
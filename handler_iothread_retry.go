@@ -0,0 +1,144 @@
+/*
+handler写出错的处理：
+
+	1. SetWriteErrorCallback: 每次写出错(重试之后仍失败)都回调一次。
+	2. SetWriteRetry: 临时性的错误(超时、EAGAIN、EINTR 等)，
+	   最多重试 maxRetries 次，每次等待时间从 backoff 开始翻倍。
+	3. SetCircuitBreaker: 某个handler连续失败 failures 次后熔断，
+	   cooldown 时间内发给它的日志直接丢弃(计入dropCnt，会调用丢日志回调)，
+	   cooldown 之后再试一次，成功则恢复。
+
+	注意：重试期间IO线程是阻塞的，backoff 不宜设置太大。
+*/
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+type WriteErrorCallbackFunc func(h Handler, err error)
+
+// 重试等待最多翻倍到这个值
+const MAX_RETRY_BACKOFF = time.Second
+
+type handlerHealth struct {
+	failures  int
+	openUntil time.Time
+}
+
+func (self *HandleIOWriteThread) SetWriteErrorCallback(f WriteErrorCallbackFunc) {
+	self.writeErrorCallbackFunc = f
+}
+
+// maxRetries <= 0 时不重试
+func (self *HandleIOWriteThread) SetWriteRetry(maxRetries int, backoff time.Duration) {
+	self.maxRetries = maxRetries
+	self.retryBackoff = backoff
+}
+
+// failures <= 0 时不熔断
+func (self *HandleIOWriteThread) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	self.healthMu.Lock()
+	defer self.healthMu.Unlock()
+
+	self.breakerFailures = failures
+	self.breakerCooldown = cooldown
+	self.health = make(map[Handler]*handlerHealth)
+}
+
+// handler是否可用(没有熔断)
+func (self *HandleIOWriteThread) HandlerHealthy(h Handler) bool {
+	return !self.breakerOpen(h)
+}
+
+// 临时性的错误才值得重试
+func isTransientError(err error) bool {
+	if errors.Is(err, io.ErrShortWrite) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+func (self *HandleIOWriteThread) writeWithRetry(h Handler, p []byte) (n int, err error) {
+	backoff := self.retryBackoff
+	for i := 0; ; i++ {
+		var m int
+		m, err = h.Write(p[n:])
+		if m > 0 {
+			n += m
+		}
+		if err == nil || i >= self.maxRetries || !isTransientError(err) {
+			return
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MAX_RETRY_BACKOFF {
+			backoff = MAX_RETRY_BACKOFF
+		}
+	}
+}
+
+// 记录写的结果，更新熔断状态
+func (self *HandleIOWriteThread) writeDone(h Handler, err error) {
+	if err != nil && self.writeErrorCallbackFunc != nil {
+		self.writeErrorCallbackFunc(h, err)
+	}
+
+	// breakerFailures 可能在别的goroutine中被 SetCircuitBreaker 修改，要在锁内读
+	self.healthMu.Lock()
+	defer self.healthMu.Unlock()
+
+	if self.breakerFailures <= 0 {
+		return
+	}
+
+	hh := self.health[h]
+	if err == nil {
+		if hh != nil {
+			delete(self.health, h)
+		}
+		return
+	}
+
+	if hh == nil {
+		hh = new(handlerHealth)
+		self.health[h] = hh
+	}
+	hh.failures++
+	if hh.failures >= self.breakerFailures {
+		hh.openUntil = time.Now().Add(self.breakerCooldown)
+	}
+}
+
+func (self *HandleIOWriteThread) breakerOpen(h Handler) bool {
+	self.healthMu.Lock()
+	defer self.healthMu.Unlock()
+
+	if self.breakerFailures <= 0 {
+		return false
+	}
+
+	hh := self.health[h]
+	return hh != nil && time.Now().Before(hh.openUntil)
+}
+
+// 本包内部的错误不能再写回日志(可能递归)，直接输出到stderr
+func reportInternalError(err error) {
+	fmt.Fprintf(os.Stderr, "\nPKG[wps.cn/log] err: %v\n", err)
+}
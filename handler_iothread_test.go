@@ -0,0 +1,264 @@
+package log4go_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Temporary() bool { return true }
+
+var errPermanent = errors.New("permanent error")
+
+// 按顺序返回errs中的错误，用完之后写成功
+type failingHandler struct {
+	*log.NullHandler
+	th asyncWriter
+
+	mu    sync.Mutex
+	errs  []error
+	calls int
+	data  []byte
+}
+
+type asyncWriter interface {
+	AsyncWrite(h log.Handler, fmt log.Formatter, l *log.LogInstance)
+}
+
+func newFailingHandler(th asyncWriter, errs ...error) *failingHandler {
+	h, _ := log.NewNullHandler()
+	return &failingHandler{NullHandler: h, th: th, errs: errs}
+}
+
+func (h *failingHandler) AsyncWrite(fmt log.Formatter, l *log.LogInstance) {
+	h.th.AsyncWrite(h, fmt, l)
+}
+
+func (h *failingHandler) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.calls++
+	if len(h.errs) > 0 {
+		err := h.errs[0]
+		h.errs = h.errs[1:]
+		if err == io.ErrShortWrite {
+			// 写一半
+			h.data = append(h.data, p[:len(p)/2]...)
+			return len(p) / 2, err
+		}
+		return 0, err
+	}
+	h.data = append(h.data, p...)
+	return len(p), nil
+}
+
+func (h *failingHandler) setErrs(errs ...error) {
+	h.mu.Lock()
+	h.errs = errs
+	h.mu.Unlock()
+}
+
+func (h *failingHandler) stat() (calls int, data string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls, string(h.data)
+}
+
+// 等IO线程把日志处理完(写入或丢弃)
+func waitProcessed(t *testing.T, th interface {
+	Stat() (string, int64, int64)
+}, n int64) {
+	for i := 0; i < 200; i++ {
+		if _, write, drop := th.Stat(); write+drop >= n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("IO thread did not process %d logs", n)
+}
+
+func TestWriteErrorCallback(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testWriteError", 128)
+	defer th.Close()
+
+	var gotErr error
+	var gotHandler log.Handler
+	th.SetWriteErrorCallback(func(h log.Handler, err error) {
+		gotHandler, gotErr = h, err
+	})
+
+	h := newFailingHandler(th, errPermanent)
+	logger := log.NewLogger(h, 0)
+	logger.Info("hello")
+	waitProcessed(t, th, 1)
+	th.Close()
+
+	if gotErr != errPermanent || gotHandler != h {
+		t.Fatalf("callback got handler=%v err=%v", gotHandler, gotErr)
+	}
+	if m := th.Metrics(); m.WriteErrors != 1 {
+		t.Fatalf("expect 1 write error, got %d", m.WriteErrors)
+	}
+}
+
+func TestWriteRetryTransient(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testRetryTransient", 128)
+	defer th.Close()
+	th.SetWriteRetry(3, time.Millisecond)
+	th.SetWriteErrorCallback(func(h log.Handler, err error) {
+		t.Errorf("unexpected write error: %v", err)
+	})
+
+	h := newFailingHandler(th, tempError{}, io.ErrShortWrite)
+	logger := log.NewLogger(h, 0)
+	logger.Info("hello retry")
+	waitProcessed(t, th, 1)
+	th.Close()
+
+	calls, data := h.stat()
+	if calls != 3 || data != "hello retry\n" {
+		t.Fatalf("calls=%d data=%q", calls, data)
+	}
+}
+
+func TestWriteRetryExhausted(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testRetryExhausted", 128)
+	defer th.Close()
+	th.SetWriteRetry(2, time.Millisecond)
+
+	var errCnt int
+	th.SetWriteErrorCallback(func(h log.Handler, err error) { errCnt++ })
+
+	h := newFailingHandler(th, tempError{}, tempError{}, tempError{})
+	log.NewLogger(h, 0).Info("hello")
+	waitProcessed(t, th, 1)
+	th.Close()
+
+	if calls, _ := h.stat(); calls != 3 || errCnt != 1 {
+		t.Fatalf("calls=%d errCnt=%d", calls, errCnt)
+	}
+}
+
+func TestWriteNoRetryPermanent(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testNoRetry", 128)
+	defer th.Close()
+	th.SetWriteRetry(3, time.Millisecond)
+
+	h := newFailingHandler(th, errPermanent)
+	log.NewLogger(h, 0).Info("hello")
+	waitProcessed(t, th, 1)
+	th.Close()
+
+	if calls, _ := h.stat(); calls != 1 {
+		t.Fatalf("permanent error should not retry, calls=%d", calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testBreaker", 128)
+	defer th.Close()
+	th.SetCircuitBreaker(2, 50*time.Millisecond)
+
+	var dropped []string
+	th.SetDropCallback(func(l *log.LogInstance, sum int64) {
+		dropped = append(dropped, l.Msg)
+	})
+
+	h := newFailingHandler(th, errPermanent, errPermanent)
+	logger := log.NewLogger(h, 0)
+
+	logger.Info("fail-1")
+	waitProcessed(t, th, 1)
+	if !th.HandlerHealthy(h) {
+		t.Fatal("one failure should not open the breaker")
+	}
+
+	logger.Info("fail-2")
+	waitProcessed(t, th, 2)
+	if th.HandlerHealthy(h) {
+		t.Fatal("breaker should be open after 2 failures")
+	}
+
+	logger.Info("dropped")
+	waitProcessed(t, th, 3)
+	if calls, _ := h.stat(); calls != 2 {
+		t.Fatalf("handler should not be written while breaker open, calls=%d", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	logger.Info("recovered")
+	waitProcessed(t, th, 4)
+	th.Close()
+
+	if !th.HandlerHealthy(h) {
+		t.Fatal("breaker should close after a successful write")
+	}
+	if len(dropped) != 1 || dropped[0] != "dropped" {
+		t.Fatalf("dropped=%v", dropped)
+	}
+	if _, data := h.stat(); data != "recovered\n" {
+		t.Fatalf("data=%q", data)
+	}
+}
+
+func TestWritePoolErrorHandling(t *testing.T) {
+	pool := log.NewHandleIOWritePool("testPoolRetry", 2, 128)
+	defer pool.Close()
+	pool.SetWriteRetry(3, time.Millisecond)
+	pool.SetCircuitBreaker(2, time.Minute)
+
+	var errCnt int32
+	pool.SetWriteErrorCallback(func(h log.Handler, err error) {
+		atomic.AddInt32(&errCnt, 1)
+	})
+
+	// IO线程的计数在写之前就加了，等handler真正写完
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; i < 200 && !cond(); i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !cond() {
+			t.Fatal(what)
+		}
+	}
+
+	h := newFailingHandler(pool, tempError{})
+	logger := log.NewLogger(h, 0)
+	logger.Info("retried")
+	waitFor("write should be retried", func() bool {
+		calls, data := h.stat()
+		return calls == 2 && data == "retried\n"
+	})
+
+	h.setErrs(errPermanent, errPermanent)
+	logger.Info("fail-1")
+	waitFor("first failure not reported", func() bool { return atomic.LoadInt32(&errCnt) == 1 })
+	logger.Info("fail-2")
+	waitFor("breaker should be open after 2 failures", func() bool { return !pool.HandlerHealthy(h) })
+
+	logger.Info("dropped")
+	waitProcessed(t, pool, 4)
+	pool.Close()
+
+	if calls, _ := h.stat(); calls != 4 || atomic.LoadInt32(&errCnt) != 2 {
+		t.Fatalf("calls=%d errCnt=%d", calls, errCnt)
+	}
+}
+
+func TestTimeRollFileWriteError(t *testing.T) {
+	f := log.NewTimeRollFile("test", "/nonexistent-dir/", log.RollTypeDay)
+	err := f.Write(time.Now().Unix(), []byte("hello\n"))
+	if err == nil || !strings.Contains(err.Error(), "nonexistent-dir") {
+		t.Fatalf("expect open error, got %v", err)
+	}
+}
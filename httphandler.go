@@ -0,0 +1,361 @@
+/*
+HTTPHandler 把日志攒成一批，POST 到日志收集服务：
+
+	h, _ := log.NewHTTPHandler("https://collector/api/logs", 10000)
+	h.SetBatch(1<<20, 2*time.Second)   // 攒够1MB或者最早一条等了2秒就发送
+	h.SetBatchFormat(log.HTTPBatchJSONArray)  // 默认 NDJSON，一行一条
+	h.SetGzip(true)
+	h.SetHeader("X-App", "myapp")
+	h.SetBearerToken(token)            // 或 SetBasicAuth(user, passwd)
+	h.SetRetry(5, time.Second)         // 失败后等1s、2s、4s...重试，最多5次
+	h.SetDropCallback(func(l *log.LogInstance, sum int64) { ... })
+	log.SetHandler(h)
+
+	IO线程格式化好的日志放进容量为 queueLen 的队列，由单独的goroutine批量发送，
+	IO线程不会因为HTTP慢而阻塞。队列满了、或者重试之后仍然失败的日志会被丢弃，
+	丢弃时调用 DropCallback，此时 LogInstance 只有 Msg，是格式化好的整条日志。
+
+	默认用 JSONFormatter，不用Logger的Formatter，可以用 SetFormatter 修改。
+	Set方法都要在写日志之前调用。
+*/
+package log4go
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HTTPBatchNDJSON = iota
+	HTTPBatchJSONArray
+)
+
+const (
+	DEFAULT_HTTP_BATCH_BYTES = 1 << 20
+	DEFAULT_HTTP_BATCH_AGE   = time.Second
+	MAX_HTTP_RETRY_BACKOFF   = 30 * time.Second
+)
+
+var errHTTPHandlerClosed = errors.New("http handler closed")
+
+//HTTPHandler posts logs in batches to a http endpoint.
+type HTTPHandler struct {
+	url    string
+	label  string // 去掉了用户名密码与查询参数的url，用于出错信息与统计
+	client *http.Client
+	header http.Header
+
+	batchFormat  int
+	batchBytes   int
+	batchAge     time.Duration
+	gzip         bool
+	maxRetries   int
+	retryBackoff time.Duration
+
+	formatter   Formatter
+	writeThread iHandleIOWriteThread
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	start  sync.Once
+	wg     sync.WaitGroup
+
+	sentCnt             int64
+	dropCnt             int64
+	dropLogCallbackFunc DropLogCallbackFunc
+}
+
+// queueLen 是待发送队列的长度(条数)
+func NewHTTPHandler(rawurl string, queueLen int) (*HTTPHandler, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	if queueLen <= 0 {
+		return nil, fmt.Errorf("http handler queue length must >0")
+	}
+
+	h := new(HTTPHandler)
+	h.url = rawurl
+	h.label = httpLabel(rawurl)
+	h.client = &http.Client{Timeout: 10 * time.Second}
+	h.header = make(http.Header)
+	h.batchBytes = DEFAULT_HTTP_BATCH_BYTES
+	h.batchAge = DEFAULT_HTTP_BATCH_AGE
+	h.retryBackoff = time.Second
+	h.formatter = &JSONFormatter{}
+	h.queue = make(chan []byte, queueLen)
+	return h, nil
+}
+
+// 攒够 maxBytes 字节，或者最早的一条等了 maxAge，就发送一批
+func (h *HTTPHandler) SetBatch(maxBytes int, maxAge time.Duration) {
+	h.batchBytes = maxBytes
+	h.batchAge = maxAge
+}
+
+// HTTPBatchNDJSON(默认) 或 HTTPBatchJSONArray
+func (h *HTTPHandler) SetBatchFormat(format int) {
+	h.batchFormat = format
+}
+
+func (h *HTTPHandler) SetGzip(on bool) {
+	h.gzip = on
+}
+
+func (h *HTTPHandler) SetHeader(key, value string) {
+	h.header.Set(key, value)
+}
+
+func (h *HTTPHandler) SetBasicAuth(username, password string) {
+	r := http.Request{Header: make(http.Header)}
+	r.SetBasicAuth(username, password)
+	h.header.Set("Authorization", r.Header.Get("Authorization"))
+}
+
+func (h *HTTPHandler) SetBearerToken(token string) {
+	h.header.Set("Authorization", "Bearer "+token)
+}
+
+// 发送失败时最多重试 maxRetries 次，等待时间从 backoff 开始翻倍，最多 MAX_HTTP_RETRY_BACKOFF
+func (h *HTTPHandler) SetRetry(maxRetries int, backoff time.Duration) {
+	h.maxRetries = maxRetries
+	h.retryBackoff = backoff
+}
+
+func (h *HTTPHandler) SetClient(c *http.Client) {
+	h.client = c
+}
+
+// 每条日志格式化后要是一个JSON值
+func (h *HTTPHandler) SetFormatter(f Formatter) {
+	h.formatter = f
+}
+
+func (h *HTTPHandler) SetDropCallback(f DropLogCallbackFunc) {
+	h.dropLogCallbackFunc = f
+}
+
+// 发送成功与丢弃的条数
+func (h *HTTPHandler) Stat() (sent int64, dropped int64) {
+	return atomic.LoadInt64(&h.sentCnt), atomic.LoadInt64(&h.dropCnt)
+}
+
+func (h *HTTPHandler) AsyncWrite(_ Formatter, log *LogInstance) {
+	if h.writeThread != nil {
+		h.writeThread.AsyncWrite(h, h.formatter, log)
+	} else {
+		globalWriteThread.AsyncWrite(h, h.formatter, log)
+	}
+}
+
+func (h *HTTPHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.writeThread = th
+}
+
+// p 当作一条日志
+func (h *HTTPHandler) Write(p []byte) (n int, err error) {
+	if _, err = h.WriteBatch([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 放进发送队列，不阻塞
+func (h *HTTPHandler) WriteBatch(records [][]byte) (n int, err error) {
+	h.start.Do(func() {
+		h.wg.Add(1)
+		go h.run()
+	})
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return 0, errHTTPHandlerClosed
+	}
+
+	for _, r := range records {
+		// IO线程会复用buffer，要复制一份
+		r = append([]byte(nil), bytes.TrimRight(r, "\r\n")...)
+		select {
+		case h.queue <- r:
+		default:
+			h.drop(r)
+		}
+	}
+	return len(records), nil
+}
+
+func (h *HTTPHandler) drop(r []byte) {
+	sum := atomic.AddInt64(&h.dropCnt, 1)
+	if h.dropLogCallbackFunc != nil {
+		h.dropLogCallbackFunc(&LogInstance{Msg: string(r)}, sum)
+	}
+}
+
+func (h *HTTPHandler) run() {
+	defer h.wg.Done()
+
+	var batch [][]byte
+	size := 0
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch) > 0 {
+			h.send(batch)
+		}
+		batch, size = nil, 0
+	}
+
+	for {
+		select {
+		case r, ok := <-h.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(h.batchAge)
+			}
+			batch = append(batch, r)
+			size += len(r) + 1
+			if size >= h.batchBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+func (h *HTTPHandler) encode(batch [][]byte) ([]byte, error) {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if h.gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+
+	sep := []byte{'\n'}
+	if h.batchFormat == HTTPBatchJSONArray {
+		w.Write([]byte{'['})
+		sep = []byte{','}
+	}
+	for i, r := range batch {
+		if i > 0 {
+			w.Write(sep)
+		}
+		w.Write(r)
+	}
+	if h.batchFormat == HTTPBatchJSONArray {
+		w.Write([]byte{']'})
+	} else {
+		w.Write(sep)
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+func (h *HTTPHandler) send(batch [][]byte) {
+	body, err := h.encode(batch)
+
+	backoff := h.retryBackoff
+	for i := 0; err == nil; i++ {
+		retry, e := h.post(body)
+		if e == nil {
+			atomic.AddInt64(&h.sentCnt, int64(len(batch)))
+			return
+		}
+		if !retry || i >= h.maxRetries {
+			err = e
+			break
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MAX_HTTP_RETRY_BACKOFF {
+			backoff = MAX_HTTP_RETRY_BACKOFF
+		}
+	}
+
+	reportInternalError(fmt.Errorf("http handler: %d logs dropped, %v", len(batch), err))
+	for _, r := range batch {
+		h.drop(r)
+	}
+}
+
+// 网络错误、5xx、408、429 可以重试
+func (h *HTTPHandler) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range h.header {
+		req.Header[k] = v
+	}
+	if h.batchFormat == HTTPBatchJSONArray {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if h.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			// 出错信息会写到stderr，不能带上url中的token
+			ue.URL = h.label
+		}
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("POST %s: %s", h.label, resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// 关闭IO线程，把队列中的日志发送完
+func (h *HTTPHandler) Close() error {
+	if h.writeThread != nil {
+		h.writeThread.Close()
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.queue)
+	h.mu.Unlock()
+
+	h.start.Do(func() {}) // 没写过日志时不用启动
+	h.wg.Wait()
+	return nil
+}
@@ -0,0 +1,187 @@
+package log4go_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func newHTTPLogger(h *log.HTTPHandler, name string) *log.Logger {
+	h.SetWriteIOThread(log.NewHandleIOWriteThread(name, 1024))
+	logger := log.NewLogger(h, log.Llevel)
+	logger.SetLevel(log.LevelTrace)
+	return logger
+}
+
+func TestHTTPHandlerNDJSON(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-ndjson" ||
+			r.Header.Get("Content-Encoding") != "gzip" ||
+			r.Header.Get("X-App") != "test" {
+			t.Errorf("unexpected header: %v", r.Header)
+		}
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "passwd" {
+			t.Errorf("unexpected auth: %v", r.Header.Get("Authorization"))
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		mu.Lock()
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	h, err := log.NewHTTPHandler(srv.URL, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetBatch(1<<20, time.Hour) // 只在Close时发送
+	h.SetGzip(true)
+	h.SetHeader("X-App", "test")
+	h.SetBasicAuth("user", "passwd")
+
+	logger := newHTTPLogger(h, "testHTTPNDJSON")
+	for i := 0; i < 10; i++ {
+		logger.WithField("n", i).Info("msg %d", i)
+	}
+	logger.Close()
+
+	if len(lines) != 10 {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	for i, line := range lines {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("line %d: %v, %q", i, err, line)
+		}
+		if m["n"] != float64(i) || m["level"] != "INFO" {
+			t.Fatalf("line %d: %q", i, line)
+		}
+	}
+	if sent, dropped := h.Stat(); sent != 10 || dropped != 0 {
+		t.Fatalf("sent=%d dropped=%d", sent, dropped)
+	}
+}
+
+func TestHTTPHandlerJSONArrayRetry(t *testing.T) {
+	var calls int32
+	batches := make(chan []map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected auth: %q", r.Header.Get("Authorization"))
+		}
+		var batch []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		batches <- batch
+	}))
+	defer srv.Close()
+
+	h, _ := log.NewHTTPHandler(srv.URL, 100)
+	h.SetBatch(1<<20, 20*time.Millisecond)
+	h.SetBatchFormat(log.HTTPBatchJSONArray)
+	h.SetBearerToken("token")
+	h.SetRetry(3, time.Millisecond)
+
+	logger := newHTTPLogger(h, "testHTTPArray")
+	logger.Warn("a")
+	logger.Error("b")
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 || batch[0]["msg"] != "a" || batch[1]["msg"] != "b" {
+			t.Fatalf("unexpected batch: %v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch not sent by age")
+	}
+	logger.Close()
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("calls=%d", n)
+	}
+}
+
+func TestHTTPHandlerDrop(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusBadRequest) // 不重试
+	}))
+	defer srv.Close()
+
+	h, _ := log.NewHTTPHandler(srv.URL, 2)
+	h.SetBatch(1, time.Hour) // 一条一批
+	var dropped []string
+	var mu sync.Mutex
+	h.SetDropCallback(func(l *log.LogInstance, sum int64) {
+		mu.Lock()
+		dropped = append(dropped, l.Msg)
+		mu.Unlock()
+	})
+
+	logger := newHTTPLogger(h, "testHTTPDrop")
+	for i := 0; i < 10; i++ {
+		logger.Info("x")
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	logger.Close()
+
+	// 1条在发送中，2条在队列中，其它溢出；发送的3条都被400拒绝
+	if sent, n := h.Stat(); sent != 0 || n != 10 || len(dropped) != 10 {
+		t.Fatalf("sent=%d dropped=%d callback=%d", sent, n, len(dropped))
+	}
+	if !strings.Contains(dropped[0], `"msg":"x"`) {
+		t.Fatalf("unexpected dropped log: %q", dropped[0])
+	}
+}
+
+func TestHTTPHandlerMetricsLabel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	u := strings.Replace(srv.URL, "://", "://user:secret@", 1) + "/logs?token=abc"
+	h, err := log.NewHTTPHandler(u, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := log.NewHandleIOWriteThread("testHTTPMetrics", 1024)
+	h.SetWriteIOThread(th)
+	logger := log.NewLogger(h, log.Llevel)
+	logger.Info("x")
+	th.Close()
+	h.Close()
+
+	// 统计的标签中不能有用户名密码与查询参数
+	expect := srv.URL + "/logs"
+	for label := range th.Metrics().HandlerBytes {
+		if label != expect {
+			t.Fatalf("expect label %q, got %q", expect, label)
+		}
+	}
+	if _, ok := th.Metrics().HandlerBytes[expect]; !ok {
+		t.Fatalf("no bytes for %q: %v", expect, th.Metrics().HandlerBytes)
+	}
+}
@@ -4,15 +4,49 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 type LogInstance struct {
-	Flag  int
-	Level string
-	File  string
-	Time  string
-	Msg   string
-	KV    Fields
+	Flag    int
+	LevelNo int // LevelTrace ... LevelBuss
+	Level   string
+	File    string
+	Time    string
+	Msg     string
+	KV      Fields
+
+	// 日志产生的时间，Time 是它按Logger的 TimeFormatter 格式化后的字符串
+	Timestamp time.Time
+
+	// 延迟格式化时，由调用方记录的原始数据，参看 log_deferred.go
+	deferred      bool
+	msgDeferred   bool
+	safeArgs      bool // args 中有 log.Safe 标记的值
+	timeFormatter *TimeFormatter
+	pc            uintptr
+	format        string
+	args          []interface{}
+
+	// 不为nil时，Formatter 之前脱敏
+	redactor *Redactor
+
+	// Logger 的名字，v2 帧头用，参看 socket_frame.go
+	logger string
+
+	// 还有几个handler没处理完，为0时放回 LogInstenceBuffer
+	refs int32
+}
+
+// 一条日志可能同时交给多个handler，每个handler处理完(写完或丢弃)后调用一次，
+// 最后一个调用者负责把它放回 LogInstenceBuffer。
+func (l *LogInstance) Release() {
+	if atomic.AddInt32(&l.refs, -1) > 0 {
+		return
+	}
+	l.reset()
+	LogInstenceBuffer.Put(l)
 }
 
 type Formatter interface {
@@ -21,6 +55,9 @@ type Formatter interface {
 
 type JSONFormatter struct {
 	// TODO: https://jsoniter.com/index.cn.html
+
+	// 不为nil时，用它格式化 LogInstance.Timestamp，代替Logger的时间格式
+	TimeFormatter *TimeFormatter
 }
 
 const (
@@ -36,6 +73,9 @@ func (j *JSONFormatter) Format(writeTobuff *bytes.Buffer,
 	kv := l.KV
 	kv[keyFileNo] = l.File
 	kv[keyTime] = l.Time
+	if j.TimeFormatter != nil {
+		kv[keyTime] = j.TimeFormatter.Format(l.Timestamp)
+	}
 	kv[keyLevel] = l.Level
 	kv[keyMsg] = l.Msg
 
@@ -49,13 +89,19 @@ func (j *JSONFormatter) Format(writeTobuff *bytes.Buffer,
 }
 
 type TxtLineFormatter struct {
+	// 不为nil时，用它格式化 LogInstance.Timestamp，代替Logger的时间格式
+	TimeFormatter *TimeFormatter
 }
 
-func (_ *TxtLineFormatter) Format(writeTobuff *bytes.Buffer,
+func (t *TxtLineFormatter) Format(writeTobuff *bytes.Buffer,
 	l *LogInstance) (*bytes.Buffer, error) {
 
 	if l.Flag&Ltime > 0 {
-		writeTobuff.WriteString(l.Time)
+		if t.TimeFormatter != nil {
+			writeTobuff.WriteString(t.TimeFormatter.Format(l.Timestamp))
+		} else {
+			writeTobuff.WriteString(l.Time)
+		}
 		writeTobuff.WriteString(FieldSplit)
 	}
 
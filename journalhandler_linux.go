@@ -0,0 +1,298 @@
+//go:build linux
+// +build linux
+
+/*
+JournalHandler 用 journald 的原生协议写日志，可以用 journalctl 按字段过滤：
+
+	h, _ := log.NewJournalHandler("", "myapp")  // 默认 /run/systemd/journal/socket
+	log.SetHandler(h)
+
+	journalctl -t myapp PRIORITY=3 REQ_ID=123
+
+	每条日志一个报文，包含这些字段:
+	    MESSAGE、PRIORITY(参看 SyslogSeverity)、SYSLOG_IDENTIFIER，
+	    带 Lfile 时还有 CODE_FILE、CODE_LINE、CODE_FUNC，
+	    Fields 的key转成大写，非字母数字的字符换成 '_'，如 req-id => REQ_ID；
+	    与 journald 有特殊含义的字段重名时加 F_ 前缀，如 priority => F_PRIORITY，参看 journalReservedFields。
+	报文超过socket的限制时，内容写到 memfd(封印为只读)，不支持时写到 /dev/shm 下的临时文件，
+	再把文件描述符发给 journald。
+	Logger 的 Formatter 对此handler无效。
+*/
+package log4go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const JournalSocketPath = "/run/systemd/journal/socket"
+
+//JournalHandler writes log to systemd-journald with the native protocol.
+type JournalHandler struct {
+	path       string
+	identifier string
+
+	mu   sync.Mutex
+	c    *net.UnixConn // 不connect，发送fd时 WriteMsgUnix 不能用于已connect的socket
+	addr *net.UnixAddr
+
+	fmt         *journalFormatter
+	writeThread iHandleIOWriteThread
+}
+
+// socketPath 为空时用 JournalSocketPath；identifier 为 SYSLOG_IDENTIFIER，为空时不写
+func NewJournalHandler(socketPath string, identifier string) (*JournalHandler, error) {
+	if socketPath == "" {
+		socketPath = JournalSocketPath
+	}
+
+	h := new(JournalHandler)
+	h.path = socketPath
+	h.addr = &net.UnixAddr{Name: socketPath, Net: "unixgram"}
+	h.identifier = identifier
+	h.fmt = &journalFormatter{h}
+	return h, nil
+}
+
+// 忽略Logger的Formatter，用journald的格式
+func (h *JournalHandler) AsyncWrite(_ Formatter, log *LogInstance) {
+	if h.writeThread != nil {
+		h.writeThread.AsyncWrite(h, h.fmt, log)
+	} else {
+		globalWriteThread.AsyncWrite(h, h.fmt, log)
+	}
+}
+
+func (h *JournalHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.writeThread = th
+}
+
+// p 当作一条已经编码好的日志
+func (h *JournalHandler) Write(p []byte) (n int, err error) {
+	if _, err = h.WriteBatch([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *JournalHandler) WriteBatch(records [][]byte) (n int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.c == nil {
+		h.c, err = net.ListenUnixgram("unixgram",
+			&net.UnixAddr{Name: "", Net: "unixgram"})
+		if err != nil {
+			return
+		}
+	}
+
+	for _, r := range records {
+		_, _, err = h.c.WriteMsgUnix(r, nil, h.addr)
+		if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+			err = h.writeViaFile(r)
+		}
+		if err != nil {
+			h.c.Close()
+			h.c = nil
+			return
+		}
+		n++
+	}
+	return
+}
+
+// 大的日志写到 memfd 或 /dev/shm 下的临时文件，只发送文件描述符。
+// 不用磁盘上的临时目录：journald 只接受封印的 memfd 或 tmpfs 上的文件
+func (h *JournalHandler) writeViaFile(p []byte) error {
+	f, err := writeMemfd(p)
+	if err != nil {
+		if f, err = writeShmFile(p); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	_, _, err = h.c.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), h.addr)
+	return err
+}
+
+func writeShmFile(p []byte) (*os.File, error) {
+	f, err := os.CreateTemp("/dev/shm", "log4go-journal-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if _, err = f.Write(p); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// memfd_create 的系统调用号，标准库 syscall 中只有部分架构有 SYS_MEMFD_CREATE
+var memfdCreateTrap = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"riscv64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"s390x":    350,
+}
+
+const (
+	_MFD_CLOEXEC       = 0x1
+	_MFD_ALLOW_SEALING = 0x2
+	_F_ADD_SEALS       = 1033
+	// F_SEAL_SEAL | F_SEAL_SHRINK | F_SEAL_GROW | F_SEAL_WRITE
+	_F_SEAL_ALL = 0x1 | 0x2 | 0x4 | 0x8
+)
+
+// 写到 memfd 并封印，内核不支持时返回错误
+func writeMemfd(p []byte) (*os.File, error) {
+	trap, ok := memfdCreateTrap[runtime.GOARCH]
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+
+	name := []byte("log4go-journal\x00")
+	fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(&name[0])),
+		_MFD_CLOEXEC|_MFD_ALLOW_SEALING, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	f := os.NewFile(fd, "log4go-journal")
+
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, _F_ADD_SEALS, _F_SEAL_ALL); errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+	return f, nil
+}
+
+func (h *JournalHandler) Close() error {
+	if h.writeThread != nil {
+		h.writeThread.Close()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.c != nil {
+		h.c.Close()
+		h.c = nil
+	}
+	return nil
+}
+
+//----------- journald 原生协议 ------------------------
+
+type journalFormatter struct {
+	h *JournalHandler
+}
+
+func (f *journalFormatter) Format(buff *bytes.Buffer,
+	l *LogInstance) (*bytes.Buffer, error) {
+
+	priority := 7
+	if l.LevelNo >= 0 && l.LevelNo < len(SyslogSeverity) {
+		priority = SyslogSeverity[l.LevelNo]
+	}
+
+	writeJournalField(buff, "MESSAGE", strings.TrimRight(l.Msg, "\n"))
+	writeJournalField(buff, "PRIORITY", strconv.Itoa(priority))
+	if f.h.identifier != "" {
+		writeJournalField(buff, "SYSLOG_IDENTIFIER", f.h.identifier)
+	}
+
+	if l.Flag&Lfile > 0 && l.pc != 0 {
+		c := lookupCaller(l.pc)
+		writeJournalField(buff, "CODE_FILE", c.file)
+		writeJournalField(buff, "CODE_LINE", strconv.Itoa(c.line))
+		writeJournalField(buff, "CODE_FUNC", c.function)
+	}
+
+	for _, k := range sortedKeys(l.KV) {
+		writeJournalField(buff, journalFieldName(k), fmt.Sprint(l.KV[k]))
+	}
+	return buff, nil
+}
+
+// 没有换行的值: KEY=value\n
+// 有换行的值:   KEY\n + 64位小端长度 + value + \n
+func writeJournalField(buff *bytes.Buffer, key string, value string) {
+	buff.WriteString(key)
+	if strings.IndexByte(value, '\n') < 0 {
+		buff.WriteByte('=')
+	} else {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		buff.WriteByte('\n')
+		buff.Write(size[:])
+	}
+	buff.WriteString(value)
+	buff.WriteByte('\n')
+}
+
+// 本handler自己写的，或 journald 有特殊含义的字段，Fields 中重名的加 F_ 前缀
+var journalReservedFields = map[string]bool{
+	"MESSAGE":            true,
+	"MESSAGE_ID":         true,
+	"PRIORITY":           true,
+	"SYSLOG_IDENTIFIER":  true,
+	"SYSLOG_FACILITY":    true,
+	"SYSLOG_PID":         true,
+	"SYSLOG_TIMESTAMP":   true,
+	"SYSLOG_RAW":         true,
+	"CODE_FILE":          true,
+	"CODE_LINE":          true,
+	"CODE_FUNC":          true,
+	"ERRNO":              true,
+	"TID":                true,
+	"UNIT":               true,
+	"USER_UNIT":          true,
+	"INVOCATION_ID":      true,
+	"USER_INVOCATION_ID": true,
+	"DOCUMENTATION":      true,
+}
+
+// journald 的字段名只能是大写字母、数字、'_'，不能以 '_' 或数字开头
+func journalFieldName(k string) string {
+	b := []byte(strings.ToUpper(k))
+	for i, c := range b {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+
+	s := strings.TrimLeft(string(b), "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') || journalReservedFields[s] ||
+		strings.HasPrefix(s, "OBJECT_") || strings.HasPrefix(s, "COREDUMP_") {
+		s = "F_" + s
+	}
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
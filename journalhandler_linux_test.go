@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package log4go_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+// 解析 journald 原生协议
+func parseJournalEntry(t *testing.T, p []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "=\n")
+		if i < 0 {
+			t.Fatalf("bad entry: %q", p)
+		}
+		key := string(p[:i])
+		if p[i] == '=' {
+			j := bytes.IndexByte(p, '\n')
+			fields[key] = string(p[i+1 : j])
+			p = p[j+1:]
+			continue
+		}
+		size := int(binary.LittleEndian.Uint64(p[i+1:]))
+		p = p[i+9:]
+		fields[key] = string(p[:size])
+		p = p[size+1:]
+	}
+	return fields
+}
+
+func TestJournalHandler(t *testing.T) {
+	dir, err := os.MkdirTemp("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	h, _ := log.NewJournalHandler(addr, "testapp")
+	th := log.NewHandleIOWriteThread("testJournal", 1024)
+	th.SetWriteErrorCallback(func(h log.Handler, err error) { t.Error(err) })
+	h.SetWriteIOThread(th)
+	logger := log.NewLogger(h, log.Lfile)
+	logger.SetLevel(log.LevelTrace)
+
+	logger.WithFields(log.Fields{"req-id": 7, "_x": "y", "priority": "high", "message": "m"}).Error("failed\nline2")
+	// msg 会被截断，用Fields构造大日志
+	big := strings.Repeat("x", 4<<20)
+	logger.WithField("blob", big).Info("big")
+	logger.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+
+	n, _, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := parseJournalEntry(t, buf[:n])
+	if f["MESSAGE"] != "failed\nline2" || f["PRIORITY"] != "3" ||
+		f["SYSLOG_IDENTIFIER"] != "testapp" || f["REQ_ID"] != "7" || f["X"] != "y" ||
+		f["F_PRIORITY"] != "high" || f["F_MESSAGE"] != "m" ||
+		!strings.HasSuffix(f["CODE_FILE"], "journalhandler_linux_test.go") ||
+		f["CODE_LINE"] == "" || !strings.HasSuffix(f["CODE_FUNC"], ".TestJournalHandler") {
+		t.Fatalf("unexpected entry: %q", f)
+	}
+
+	// 大日志通过文件描述符传递
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expect empty datagram with fd, got %d bytes", n)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatal(msgs, err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatal(fds, err)
+	}
+	// 优先用 memfd，不落到磁盘上
+	if target, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fds[0])); err == nil &&
+		!strings.HasPrefix(target, "/memfd:") && !strings.HasPrefix(target, "/dev/shm/") {
+		t.Fatalf("large entry passed via %s", target)
+	}
+	file := os.NewFile(uintptr(fds[0]), "journal-entry")
+	defer file.Close()
+	file.Seek(0, io.SeekStart)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = parseJournalEntry(t, data)
+	if f["BLOB"] != big || f["MESSAGE"] != "big" || f["PRIORITY"] != "6" {
+		t.Fatalf("unexpected large entry: %d bytes, PRIORITY=%s", len(f["BLOB"]), f["PRIORITY"])
+	}
+}
@@ -3,7 +3,6 @@ package log4go
 import (
 	"fmt"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -21,7 +20,7 @@ const (
 )
 
 const (
-	Ltime  = 1 << iota //time format "2006/01/02 15:04:05"
+	Ltime  = 1 << iota //time format "2006/01/02 15:04:05", see SetTimeFormatter()
 	Lfile              //file.go:123
 	Llevel             //[Trace|Debug|Info...]
 )
@@ -49,7 +48,7 @@ const TimeFormat = "2006/01/02 15:04:05"
 const FieldSplit = " - "
 
 //----------- 全局对像 ------------------------
-//外部实现IOThread的话，请调用 LogInstenceBuffer.Put(hw.Log)
+//外部实现IOThread的话，写完或丢弃日志后，请调用 hw.Log.Release()
 var LogInstenceBuffer *sync.Pool
 var globalWriteThread *HandleIOWriteThread
 var globalTxtLineFormatter = new(TxtLineFormatter)
@@ -64,6 +63,7 @@ func init() {
 }
 
 type Logger struct {
+	name  string
 	level int
 	flag  int
 
@@ -71,6 +71,23 @@ type Logger struct {
 
 	kv        Fields
 	formatter Formatter
+
+	timeFormatter *TimeFormatter
+
+	// 延迟格式化，参看 SetDeferredFormat()
+	deferred bool
+
+	redactor *Redactor
+
+	// 重复日志合并，参看 dedup.go
+	deduper *deduper
+
+	// 按请求缓冲日志，参看 request_scope.go
+	scope *requestScope
+
+	// 参看 filter.go
+	filters        []Filter
+	handlerFilters bool // handlers 中有 FilterHandler
 }
 
 // 每条log最大允许大小（除去time\level\fileno几个字段后的msg字段最大限制）
@@ -86,10 +103,12 @@ func NewLogger(handler Handler, flag int) *Logger {
 
 	l.handlers = make([]Handler, 1)
 	l.handlers[0] = handler
+	l.handlerFilters = hasFilterHandler(l.handlers)
 
 	l.flag = flag
 	l.kv = make(Fields, 5)
 	l.formatter = &TxtLineFormatter{}
+	l.timeFormatter = defaultTimeFormatter
 
 	return l
 }
@@ -107,7 +126,13 @@ func newStdHandler() *StreamHandler {
 	return h
 }
 
-var std = NewDefaultLogger(newStdHandler())
+var std = newRootLogger()
+
+func newRootLogger() *Logger {
+	l := NewDefaultLogger(newStdHandler())
+	l.name = "root"
+	return l
+}
 
 type manager struct {
 	mapper map[string]interface{}
@@ -128,7 +153,9 @@ func (self *manager) get(name string) *Logger {
 	if ok {
 		return l.(*Logger)
 	} else {
-		l = NewDefaultLogger(newStdHandler())
+		ll := NewDefaultLogger(newStdHandler())
+		ll.name = name
+		l = ll
 		self.mapper[name] = l
 	}
 	return l.(*Logger)
@@ -140,6 +167,15 @@ func (self *manager) close() {
 	}
 }
 
+// IO线程关闭前，先把重复日志的汇总写出去
+func (self *manager) flushDedup() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, v := range self.mapper {
+		v.(*Logger).FlushDedup()
+	}
+}
+
 var _mgr = newManager()
 
 // like the python logging.getLogger
@@ -152,12 +188,15 @@ func GetLogger(name string) *Logger {
 }
 
 func Close() {
+	std.FlushDedup()
+	_mgr.flushDedup()
 	globalWriteThread.Close()
 	// std.Close()
 	_mgr.close()
 }
 
 func (l *Logger) Close() {
+	l.FlushDedup()
 	if l.handlers != nil {
 		for _, h := range l.handlers {
 			h.Close()
@@ -177,11 +216,13 @@ func (l *Logger) Level() int {
 // when expect Logger has only one Handler, use this function
 func (l *Logger) SetHandler(h Handler) {
 	l.handlers[0] = h
+	l.handlerFilters = hasFilterHandler(l.handlers)
 }
 
 // when expect Logger more the one Handler, use this function
 func (l *Logger) AppendHandler(h Handler) {
 	l.handlers = append(l.handlers, h)
+	l.handlerFilters = hasFilterHandler(l.handlers)
 }
 
 //a low interface, maybe you can use it for your special log format
@@ -191,10 +232,60 @@ func (l *Logger) Output(callDepth int, level int, format string, v ...interface{
 		return
 	}
 
+	var rec *FilterRecord
+	if len(l.filters) > 0 || l.handlerFilters {
+		rec = &FilterRecord{
+			Logger: l.name,
+			Level:  level,
+			Fields: l.kv,
+			format: format,
+			args:   v,
+		}
+		if !l.filter(rec) {
+			return
+		}
+	}
+
+	var pc uintptr
+	if l.flag&Lfile > 0 || l.deduper != nil {
+		pc = callerPC(callDepth)
+	}
+
+	if l.deduper != nil {
+		// 第一条日志的msg在 allow 中格式化，output 用 rec 中的，不再格式化一次
+		if rec == nil {
+			rec = &FilterRecord{
+				Logger: l.name,
+				Level:  level,
+				Fields: l.kv,
+				format: format,
+				args:   v,
+			}
+		}
+		if !l.deduper.allow(l, level, pc, rec) {
+			return
+		}
+	}
+
+	l.output(level, pc, rec, format, v)
+}
+
+// Output 过了level检查、Filter、去重之后的部分
+func (l *Logger) output(level int, pc uintptr, rec *FilterRecord,
+	format string, v []interface{}) {
+
+	countEmitted(level)
+
+	if l.deferred {
+		l.outputDeferred(level, pc, rec, format, v)
+		return
+	}
+
 	var file_line, now, slevel, msg string
 
+	t := time.Now()
 	if l.flag&Ltime > 0 {
-		now = time.Now().Format(TimeFormat)
+		now = l.timeFormatter.Format(t)
 	}
 
 	if l.flag&Llevel > 0 {
@@ -202,37 +293,24 @@ func (l *Logger) Output(callDepth int, level int, format string, v ...interface{
 	}
 
 	if l.flag&Lfile > 0 {
-		_, file, line, ok := runtime.Caller(callDepth)
-		if !ok {
-			file = "???"
-			line = 0
-		} else {
-			v := strings.Split(file, "/")
-			idx := len(v) - 3
-			if idx < 0 {
-				idx = 0
-			}
-			file = strings.Join(v[idx:], "/")
-		}
-
-		file_line = fmt.Sprintf("%s:[%d]", file, line)
+		file_line = lookupCaller(pc).fileLine
 	}
 
-	msg = fmt.Sprintf(format, v...)
-	if len(msg) > MAX_BYTES_PER_LOG {
-		// MAX_BYTES_PER_LOG 默认是3k
-		// 只允许写入3K日志数据防止日志太长内存拷贝以及IO上升.
-		//   -- by pengweilin 2017-03-02
-		msg = fmt.Sprintf("%s... data too long, soucre-length=%d",
-			msg[0:MAX_BYTES_PER_LOG], len(msg))
+	if rec != nil {
+		msg = rec.Msg()
+	} else {
+		msg = truncateMsg(fmt.Sprintf(format, v...))
 	}
 
 	log := LogInstenceBuffer.Get().(*LogInstance)
 	log.Flag = l.flag
+	log.LevelNo = level
 	log.File = file_line
+	log.pc = pc
 	log.Level = slevel
 	log.KV = l.kv
 	log.Time = now
+	log.Timestamp = t
 	log.Msg = msg
 	// log := LogInstance{
 	// 	Flag:  l.flag,
@@ -243,13 +321,54 @@ func (l *Logger) Output(callDepth int, level int, format string, v ...interface{
 	// 	KV:    l.kv,
 	// }
 
-	for _, h := range l.handlers {
-		if h != nil {
+	l.dispatch(log, rec)
+}
+
+// rec 不为nil时，跳过被 FilterHandler 拒绝的handler
+func (l *Logger) dispatch(log *LogInstance, rec *FilterRecord) {
+	if l.scope != nil && l.scope.add(l, log, rec) {
+		return
+	}
+
+	refs := int32(0)
+	for i, h := range l.handlers {
+		if h != nil && rec.handlerAllowed(i, h) {
+			refs++
+		}
+	}
+	if refs == 0 {
+		log.Release()
+		return
+	}
+	log.refs = refs
+	log.redactor = l.redactor
+	log.logger = l.name
+
+	if refs > 1 {
+		// 多个handler可能在不同的IO线程同时处理同一个 LogInstance,
+		// 这里直接格式化好、脱敏，避免并发修改。
+		log.resolve()
+		log.redact()
+	}
+
+	for i, h := range l.handlers {
+		if h != nil && rec.handlerAllowed(i, h) {
 			h.AsyncWrite(l.formatter, log)
 		}
 	}
 }
 
+func truncateMsg(msg string) string {
+	if len(msg) > MAX_BYTES_PER_LOG {
+		// MAX_BYTES_PER_LOG 默认是3k
+		// 只允许写入3K日志数据防止日志太长内存拷贝以及IO上升.
+		//   -- by pengweilin 2017-03-02
+		msg = fmt.Sprintf("%s... data too long, soucre-length=%d",
+			msg[0:MAX_BYTES_PER_LOG], len(msg))
+	}
+	return msg
+}
+
 //log with Trace level
 func (l *Logger) Trace(format string, v ...interface{}) {
 	l.Output(2, LevelTrace, format, v...)
@@ -305,7 +424,6 @@ func SetDropCallback(f DropLogCallbackFunc) {
 func SetGlobalWriteThreadChanBufferLen(length int) {
 	if length <= 0 {
 		panic("buffer length must >0.")
-		return
 	}
 	// TODO: maybe need a lock.
 	globalWriteThread.Close()
@@ -0,0 +1,71 @@
+package log4go
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 调用者信息，按PC缓存。
+// 同一行代码的PC是固定的，解析一次后，以后直接查表，
+// 不用每条日志都 runtime.Caller + strings.Split/Join + fmt.Sprintf。
+type callerInfo struct {
+	file     string // 只保留最后3段，如: go/log/log_test.go
+	line     int
+	function string
+	fileLine string // file:[line]
+}
+
+var unknownCaller = &callerInfo{
+	file:     "???",
+	fileLine: "???:[0]",
+}
+
+var callerCache sync.Map // uintptr => *callerInfo
+
+// skip 与 runtime.Caller(skip) 的含义一样，0 表示调用 callerPC 的函数。
+func callerPC(skip int) uintptr {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return 0
+	}
+	return pcs[0]
+}
+
+func lookupCaller(pc uintptr) *callerInfo {
+	if pc == 0 {
+		return unknownCaller
+	}
+
+	if c, ok := callerCache.Load(pc); ok {
+		return c.(*callerInfo)
+	}
+
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	if frame.File == "" {
+		return unknownCaller
+	}
+
+	c := &callerInfo{
+		file:     trimCallerFile(frame.File),
+		line:     frame.Line,
+		function: frame.Function,
+	}
+	c.fileLine = c.file + ":[" + strconv.Itoa(c.line) + "]"
+
+	actual, _ := callerCache.LoadOrStore(pc, c)
+	return actual.(*callerInfo)
+}
+
+// 只保留路径的最后3段，如: go/log/log_test.go
+func trimCallerFile(file string) string {
+	idx := len(file)
+	for n := 0; n < 3; n++ {
+		idx = strings.LastIndexByte(file[:idx], '/')
+		if idx < 0 {
+			return file
+		}
+	}
+	return file[idx+1:]
+}
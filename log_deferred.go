@@ -0,0 +1,145 @@
+/*
+延迟格式化：
+  默认 Logger.Output 在调用方goroutine里做 fmt.Sprintf、time.Format、
+  以及 file:line 的拼接，这些开销都算在请求的耗时里。
+  打开 SetDeferredFormat(true) 后，调用方只记录原始的 time.Time、
+  调用者的PC、以及参数的不可变拷贝，字符串拼接全部放到IO线程里做。
+
+  只有以下参数可以延迟到IO线程再格式化：
+    nil、string、bool、各种整数/浮点数/复数、time.Time、time.Duration，
+    以及调用方用 log.Safe(v) 标记为安全(不会再被修改)的值。
+  只要有一个参数不满足，msg 仍在调用方格式化，time 与 file:line 照样延迟。
+
+  Safe 标记的值要一直保持不变，直到IO线程把这条日志格式化(队列中等待的时间)。
+  BeginRequest 的缓冲不会延长这段时间：有 Safe 参数的日志在进缓冲时就格式化好msg，
+  不会把参数留到 EndRequest。
+*/
+package log4go
+
+import (
+	"fmt"
+	"time"
+)
+
+// SafeArg 标记一个参数在日志输出前不会被修改，可以直接交给IO线程去格式化。
+type SafeArg struct {
+	V interface{}
+}
+
+// 如: log.Info("req=%v", log.Safe(req))
+// 调用方必需保证 req 在IO线程格式化这条日志之前不再修改。
+func Safe(v interface{}) SafeArg {
+	return SafeArg{V: v}
+}
+
+// 非延迟模式下，直接按V的格式输出。
+func (s SafeArg) Format(f fmt.State, verb rune) {
+	fmt.Fprintf(f, fmt.FormatString(f, verb), s.V)
+}
+
+// 打开后，此logger的日志在IO线程中格式化。
+// 注意：丢日志回调拿到的 LogInstance 已经格式化好了。
+func (l *Logger) SetDeferredFormat(on bool) {
+	l.deferred = on
+}
+
+func SetDeferredFormat(on bool) { std.SetDeferredFormat(on) }
+
+func (l *Logger) outputDeferred(level int, pc uintptr, rec *FilterRecord,
+	format string, v []interface{}) {
+
+	log := LogInstenceBuffer.Get().(*LogInstance)
+	log.Flag = l.flag
+	log.LevelNo = level
+	log.KV = l.kv
+
+	log.Timestamp = time.Now()
+	log.timeFormatter = l.timeFormatter
+
+	if l.flag&Llevel > 0 {
+		log.Level = LevelName[level]
+	}
+
+	if l.flag&Lfile > 0 {
+		log.pc = pc
+	}
+
+	if rec != nil && rec.msgDone {
+		// Filter 已经格式化过了
+		log.Msg = rec.msg
+	} else if args, safe, ok := captureArgs(log.args[:0], v); ok {
+		log.format = format
+		log.args = args
+		log.msgDeferred = true
+		log.safeArgs = safe
+	} else {
+		log.Msg = truncateMsg(fmt.Sprintf(format, v...))
+	}
+	log.deferred = true
+
+	l.dispatch(log, rec)
+}
+
+// 把参数拷贝到dst，有不能延迟格式化的参数时返回false
+func captureArgs(dst []interface{}, v []interface{}) (args []interface{}, safe bool, ok bool) {
+	for _, a := range v {
+		switch x := a.(type) {
+		case nil, string, bool,
+			int, int8, int16, int32, int64,
+			uint, uint8, uint16, uint32, uint64, uintptr,
+			float32, float64, complex64, complex128,
+			time.Time, time.Duration:
+			dst = append(dst, a)
+		case SafeArg:
+			dst = append(dst, x.V)
+			safe = true
+		default:
+			return dst[:0], false, false
+		}
+	}
+	return dst, safe, true
+}
+
+// 在IO线程中，把延迟的字段格式化好，Formatter 之前调用。
+func (l *LogInstance) resolve() {
+	if !l.deferred {
+		return
+	}
+
+	if l.Flag&Ltime > 0 {
+		l.Time = l.timeFormatter.Format(l.Timestamp)
+	}
+
+	if l.Flag&Lfile > 0 {
+		l.File = lookupCaller(l.pc).fileLine
+	}
+
+	l.resolveMsg()
+	l.deferred = false
+}
+
+// 只格式化msg，并去掉对参数的引用
+func (l *LogInstance) resolveMsg() {
+	if !l.msgDeferred {
+		return
+	}
+
+	l.Msg = truncateMsg(fmt.Sprintf(l.format, l.args...))
+	for i := range l.args {
+		l.args[i] = nil
+	}
+	l.args = l.args[:0]
+	l.msgDeferred = false
+	l.safeArgs = false
+}
+
+// 放回 LogInstenceBuffer 之前清空，避免pool持有参数的引用。
+func (l *LogInstance) reset() {
+	for i := range l.args {
+		l.args[i] = nil
+	}
+	args := l.args[:0]
+
+	*l = LogInstance{}
+	l.args = args
+}
@@ -14,6 +14,14 @@ func (l *Logger) clone() *Logger {
 	ll.level = l.level
 	ll.flag = l.flag
 	ll.handlers = l.handlers
+	ll.timeFormatter = l.timeFormatter
+	ll.deferred = l.deferred
+	ll.name = l.name
+	ll.redactor = l.redactor
+	ll.deduper = l.deduper
+	ll.scope = l.scope
+	ll.filters = append([]Filter(nil), l.filters...)
+	ll.handlerFilters = l.handlerFilters
 
 	for k, v := range l.kv {
 		ll.kv[k] = v
@@ -1,12 +1,19 @@
 package log4go_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"math/rand"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	log "github.com/kingsoft-wps/log4go"
 )
@@ -123,3 +130,331 @@ func TestMain(m *testing.M) {
 
 	os.Exit(n)
 }
+
+func TestHandleIOWritePool(t *testing.T) {
+	pool := log.NewHandleIOWritePool("testPool", 4, 8192)
+
+	const num_handler = 8
+	const num_log = 1000
+
+	bufs := make([]*bytes.Buffer, num_handler)
+	loggers := make([]*log.Logger, num_handler)
+	for i := 0; i < num_handler; i++ {
+		bufs[i] = new(bytes.Buffer)
+		h, _ := log.NewStreamHandler(bufs[i])
+		h.SetWriteIOThread(pool)
+		loggers[i] = log.NewLogger(h, 0)
+	}
+
+	for j := 0; j < num_log; j++ {
+		for i := 0; i < num_handler; i++ {
+			loggers[i].Info("%d-%d", i, j)
+		}
+	}
+	pool.Close()
+
+	_, write, drop := pool.Stat()
+	if write+drop != num_handler*num_log {
+		t.Fatalf("write=%d drop=%d, expect sum=%d", write, drop, num_handler*num_log)
+	}
+
+	// 每个handler内的日志顺序不能乱，且不能混入别的handler的日志
+	for i := 0; i < num_handler; i++ {
+		last := -1
+		for _, line := range strings.Split(strings.TrimSpace(bufs[i].String()), "\n") {
+			var hi, j int
+			if _, err := fmt.Sscanf(line, "%d-%d", &hi, &j); err != nil {
+				t.Fatalf("handler[%d] bad line %q: %v", i, line, err)
+			}
+			if hi != i || j <= last {
+				t.Fatalf("handler[%d] got out of order line %q after %d", i, line, last)
+			}
+			last = j
+		}
+	}
+}
+
+func TestDeferredFormat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h, _ := log.NewStreamHandler(buf)
+	th := log.NewHandleIOWriteThread("testDeferred", 1024)
+	h.SetWriteIOThread(th)
+
+	logger := log.NewLogger(h, log.Lfile|log.Llevel)
+	logger.SetDeferredFormat(true)
+
+	slice := []int{1, 2, 3}
+	logger.Info("a=%s b=%d c=%v", "x", 7, log.Safe(slice))
+	_, _, line, _ := runtime.Caller(0)
+	mutable := []int{1, 2, 3}
+	logger.Warn("mutable=%v", mutable) // 非安全参数，在调用方格式化
+	mutable[0] = 100
+	th.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, got %q", buf.String())
+	}
+
+	// 只比较文件名，目录随 GOPATH/模块路径而变
+	expect := fmt.Sprintf("log_test.go:[%d] - a=x b=7 c=[1 2 3]", line-1)
+	if !strings.HasPrefix(lines[0], "INFO - ") || !strings.HasSuffix(lines[0], expect) {
+		t.Fatalf("expect %q, got %q", expect, lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "mutable=[1 2 3]") {
+		t.Fatalf("unsafe arg should be formatted on caller, got %q", lines[1])
+	}
+}
+
+func TestTimeFormatter(t *testing.T) {
+	base := time.Date(2018, 8, 3, 10, 26, 21, 0, time.Local)
+	layouts := []string{
+		log.TimeFormat,
+		log.TimeFormatMilli,
+		log.TimeFormatRFC3339Nano,
+		"2006-01-02 15:04:05,000000 MST",
+	}
+	nsecs := []int{0, 1, 120000000, 123456789, 999999999}
+
+	for _, layout := range layouts {
+		for _, utc := range []bool{false, true} {
+			tf := log.NewTimeFormatter(layout, utc)
+			for _, ns := range nsecs {
+				// 同一秒内多次调用，走缓存
+				tm := base.Add(time.Duration(ns))
+				expect := tm.Format(layout)
+				if utc {
+					expect = tm.UTC().Format(layout)
+				}
+				if got := tf.Format(tm); got != expect {
+					t.Fatalf("layout=%q utc=%v: expect %q, got %q",
+						layout, utc, expect, got)
+				}
+			}
+		}
+	}
+
+	// 同一个 TimeFormatter 连续格式化跨秒、跨天、跨年以及往回走的时间，缓存要更新
+	sequence := []time.Time{
+		base.Add(999999999),
+		base.Add(time.Second),
+		base,
+		time.Date(2018, 8, 3, 23, 59, 59, 999000000, time.Local),
+		time.Date(2018, 8, 4, 0, 0, 0, 0, time.Local),
+		time.Date(2018, 12, 31, 23, 59, 59, 999999999, time.UTC),
+		time.Date(2019, 1, 1, 0, 0, 0, 1, time.UTC),
+	}
+	for _, layout := range layouts {
+		for _, utc := range []bool{false, true} {
+			tf := log.NewTimeFormatter(layout, utc)
+			for _, tm := range sequence {
+				expect := tm.Local().Format(layout)
+				if utc {
+					expect = tm.UTC().Format(layout)
+				}
+				if got := tf.Format(tm); got != expect {
+					t.Fatalf("layout=%q utc=%v %v: expect %q, got %q",
+						layout, utc, tm, expect, got)
+				}
+			}
+		}
+	}
+
+	tf := log.NewTimeFormatter(log.TimeFormatEpochMillis, false)
+	if got := tf.Format(base.Add(123456789)); got != fmt.Sprint(base.Unix()*1000+123) {
+		t.Fatalf("epoch millis got %q", got)
+	}
+
+	// Logger 的 TimeFormatter 对 txt、json 以及延迟格式化都生效
+	buf := new(bytes.Buffer)
+	h, _ := log.NewStreamHandler(buf)
+	th := log.NewHandleIOWriteThread("testTimeFormatter", 16)
+	h.SetWriteIOThread(th)
+	logger := log.NewLogger(h, log.Ltime)
+	logger.SetTimeFormatter(log.NewTimeFormatter(log.TimeFormatRFC3339Nano, true))
+	logger.Info("txt")
+	logger.WithField("k", "v").Info("json")
+	logger.SetDeferredFormat(true)
+	logger.Info("deferred %d", 1)
+	logger.SetDeferredFormat(false)
+
+	// nil 恢复默认格式
+	logger.SetTimeFormatter(nil)
+	logger.Info("nil")
+	th.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	var js struct {
+		Time string `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &js); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range []string{strings.Fields(lines[0])[0], js.Time, strings.Fields(lines[2])[0]} {
+		tm, err := time.Parse(log.TimeFormatRFC3339Nano, s)
+		if err != nil || !strings.HasSuffix(s, "Z") || time.Since(tm) > time.Minute {
+			t.Fatalf("line %d should use the logger's TimeFormatter, got %q", i, lines[i])
+		}
+	}
+	if _, err := time.ParseInLocation(log.TimeFormat, lines[3][:len(log.TimeFormat)],
+		time.Local); err != nil {
+		t.Fatalf("nil formatter should use TimeFormat, got %q", lines[3])
+	}
+}
+
+// 夏令时切换时时区缩写与偏移要跟着变。time.Local 在进程启动时确定，在子进程中设置 TZ 测试
+func TestTimeFormatterZoneChange(t *testing.T) {
+	if os.Getenv("LOG4GO_TEST_TZ") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTimeFormatterZoneChange$", "-test.v")
+		cmd.Env = append(os.Environ(), "LOG4GO_TEST_TZ=1", "TZ=America/New_York")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	if _, off := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local).Zone(); off != -5*3600 {
+		t.Skip("no zoneinfo for America/New_York")
+	}
+
+	layout := "2006-01-02 15:04:05.000 MST -0700"
+	tf := log.NewTimeFormatter(layout, false)
+	spring := time.Date(2018, 3, 11, 1, 59, 59, 500000000, time.Local) // EST => EDT
+	fall := time.Date(2018, 11, 4, 1, 59, 59, 500000000, time.Local)   // EDT => EST
+	for _, tm := range []time.Time{spring, spring.Add(time.Second), fall, fall.Add(time.Second)} {
+		if got, expect := tf.Format(tm), tm.Format(layout); got != expect {
+			t.Fatalf("expect %q, got %q", expect, got)
+		}
+	}
+	if got := tf.Format(spring.Add(time.Second)); !strings.Contains(got, "03:00:00.500 EDT") {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestIOThreadMetrics(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h, _ := log.NewStreamHandler(buf)
+	th := log.NewHandleIOWriteThread("testMetrics", 1024)
+	h.SetWriteIOThread(th)
+
+	logger := log.NewLogger(h, log.StdLogFlag)
+	logger.SetLevel(log.LevelDebug)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Info("info")
+	logger.Error("error")
+
+	// 等IO线程写完
+	for i := 0; i < 100; i++ {
+		if _, write, _ := th.Stat(); write == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	log.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	th.Close()
+
+	m := th.Metrics()
+	if m.Written != 4 || m.Levels["INFO"] != 2 || m.Levels["DEBUG"] != 1 ||
+		m.Levels["ERROR"] != 1 {
+		t.Fatalf("bad metrics: %+v", m)
+	}
+	if m.Latency.Count != 4 || m.QueueHighWater < 1 || m.QueueCap != 1024 {
+		t.Fatalf("bad metrics: %+v", m)
+	}
+	var sum int64
+	for _, n := range m.HandlerBytes {
+		sum += n
+	}
+	if sum != int64(buf.Len()) {
+		t.Fatalf("handler bytes=%d, buffer len=%d", sum, buf.Len())
+	}
+
+	body := rec.Body.String()
+	for _, expect := range []string{
+		`log4go_written_total{thread="testMetrics"} 4`,
+		`log4go_level_written_total{thread="testMetrics",level="INFO"} 2`,
+		`log4go_write_latency_seconds_count{thread="testMetrics"} 4`,
+		`log4go_write_latency_seconds_bucket{thread="testMetrics",le="+Inf"} 4`,
+		"# TYPE log4go_write_latency_seconds histogram",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expect %q in:\n%s", expect, body)
+		}
+	}
+}
+
+// 同名的IO线程合并输出，不能有重复的样本
+func TestMetricsDuplicateThreadName(t *testing.T) {
+	var ths []*log.HandleIOWriteThread
+	for i := 1; i <= 2; i++ {
+		h, _ := log.NewStreamHandler(new(bytes.Buffer))
+		th := log.NewHandleIOWriteThread("testMetricsDup", 128)
+		defer th.Close()
+		h.SetWriteIOThread(th)
+		logger := log.NewLogger(h, 0)
+		for j := 0; j < i; j++ {
+			logger.Info("dup")
+		}
+		ths = append(ths, th)
+	}
+	for i := 0; i < 100; i++ {
+		_, w1, _ := ths[0].Stat()
+		_, w2, _ := ths[1].Stat()
+		if w1+w2 == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	log.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	if n := strings.Count(body, `log4go_written_total{thread="testMetricsDup"}`); n != 1 {
+		t.Fatalf("%d written_total samples in:\n%s", n, body)
+	}
+	for _, expect := range []string{
+		`log4go_written_total{thread="testMetricsDup"} 3`,
+		`log4go_queue_capacity{thread="testMetricsDup"} 256`,
+		`log4go_level_written_total{thread="testMetricsDup",level="INFO"} 3`,
+		`log4go_write_latency_seconds_count{thread="testMetricsDup"} 3`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expect %q in:\n%s", expect, body)
+		}
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	th := log.NewHandleIOWriteThread("testExpvar", 128)
+	defer th.Close()
+
+	h, _ := log.NewNullHandler()
+	logger := log.NewLogger(h, 0)
+	logger.Warn("count me")
+
+	var vars struct {
+		Levels  map[string]int64
+		Threads map[string]struct {
+			WriteCnt int64
+			DropCnt  int64
+			QueueLen int
+			QueueCap int
+		}
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("log4go").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Levels["WARN"] < 1 {
+		t.Fatalf("expect WARN emitted, got %v", vars.Levels)
+	}
+	if v, ok := vars.Threads["testExpvar"]; !ok || v.QueueCap != 128 {
+		t.Fatalf("expect testExpvar thread, got %v", vars.Threads)
+	}
+}
@@ -0,0 +1,189 @@
+package logframe
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	AckType = 'A'
+	AckSize = 1 + 1 + 8 + 8
+)
+
+// 追加一个确认: session 中 seq 及以前的帧都已收到
+func AppendAck(dst []byte, session, seq uint64) []byte {
+	dst = append(dst, Magic, AckType)
+	dst = binary.BigEndian.AppendUint64(dst, session)
+	return binary.BigEndian.AppendUint64(dst, seq)
+}
+
+// 读出一个确认，发送端用
+func ReadAck(r io.Reader) (session, seq uint64, err error) {
+	var p [AckSize]byte
+	if _, err = io.ReadFull(r, p[:]); err != nil {
+		return
+	}
+	if p[0] != Magic || p[1] != AckType {
+		return 0, 0, ErrBadFrame
+	}
+	return binary.BigEndian.Uint64(p[2:]), binary.BigEndian.Uint64(p[10:]), nil
+}
+
+// 帧头中 session 的位置，帧不是带 FlagSeq 的 v2 帧时返回-1
+func seqOffset(frame []byte) int {
+	if !IsV2Frame(frame) ||
+		binary.BigEndian.Uint16(frame[2:])&FlagSeq == 0 {
+		return -1
+	}
+
+	end := V2PrefixSize + int(binary.BigEndian.Uint16(frame[4:]))
+	off := V2PrefixSize + headerFixedSize
+	for i := 0; i < 3; i++ {
+		if off >= end {
+			return -1
+		}
+		off += 1 + int(frame[off])
+	}
+	if off+16 > end {
+		return -1
+	}
+	return off
+}
+
+// 读出帧头中的 session 与 seq，帧不带 FlagSeq 时 ok 为false
+func FrameSeq(frame []byte) (session, seq uint64, ok bool) {
+	off := seqOffset(frame)
+	if off < 0 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(frame[off:]),
+		binary.BigEndian.Uint64(frame[off+8:]), true
+}
+
+// 改写帧头中的 session 与 seq，发送端在帧真正发出(或存盘)时才分配序号。
+// 帧不带 FlagSeq 时返回false
+func SetFrameSeq(frame []byte, session, seq uint64) bool {
+	off := seqOffset(frame)
+	if off < 0 {
+		return false
+	}
+	binary.BigEndian.PutUint64(frame[off:], session)
+	binary.BigEndian.PutUint64(frame[off+8:], seq)
+	return true
+}
+
+// Dedup 是接收端的去重：每个 session 记住已经处理过的最大 seq，
+// 重连后发送端重发的、已经处理过的帧丢掉。可以并发使用。
+//
+// 用法: CheckAndCommit(h, 写文件)，不是重复且写成功时回确认；
+// 写失败时断开连接让发送端重发。
+// 也可以分开调用 Duplicate 与 Commit，但两者之间没有锁，
+// 同一个 session 的帧可能从两个连接同时到达(重连时旧连接还没断)，这时会重复处理。
+type Dedup struct {
+	idle time.Duration
+
+	mu       sync.Mutex
+	sessions map[uint64]*dedupSession
+	pruned   time.Time
+}
+
+type dedupSession struct {
+	mu   sync.Mutex // CheckAndCommit 处理期间持有
+	seq  uint64     // 用 Dedup.mu
+	seen time.Time  // 用 Dedup.mu
+}
+
+// idle 时间内没有新帧的 session 被忘掉，<=0 时永远不忘
+func NewDedup(idle time.Duration) *Dedup {
+	return &Dedup{
+		idle:     idle,
+		sessions: make(map[uint64]*dedupSession),
+		pruned:   time.Now(),
+	}
+}
+
+// 帧已经处理过时返回true，不带 FlagSeq 的帧总是返回false
+func (d *Dedup) Duplicate(h *Header) bool {
+	if h.Flags&FlagSeq == 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sessions[h.Session]
+	return ok && h.Seq <= s.seq
+}
+
+// 帧没有处理过时调用 process，process 成功后记下已经处理过，返回 dup=false 与 process 的错误；
+// 已经处理过时不调用 process，返回 dup=true。
+// 同一个 session 的 process 不会并发执行，不同 session 之间可以并发。
+// 不带 FlagSeq 的帧总是调用 process
+func (d *Dedup) CheckAndCommit(h *Header, process func() error) (dup bool, err error) {
+	if h.Flags&FlagSeq == 0 {
+		return false, process()
+	}
+
+	d.mu.Lock()
+	s := d.session(h.Session, time.Now())
+	d.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.mu.Lock()
+	dup = h.Seq <= s.seq
+	d.mu.Unlock()
+	if dup {
+		return true, nil
+	}
+
+	if err = process(); err == nil {
+		d.Commit(h)
+	}
+	return false, err
+}
+
+// 取 session，没有时新建。调用时持有 d.mu
+func (d *Dedup) session(id uint64, now time.Time) *dedupSession {
+	s, ok := d.sessions[id]
+	if !ok {
+		s = new(dedupSession)
+		d.sessions[id] = s
+	}
+	s.seen = now
+	return s
+}
+
+// 记下帧已经处理过
+func (d *Dedup) Commit(h *Header) {
+	if h.Flags&FlagSeq == 0 {
+		return
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.session(h.Session, now)
+	if h.Seq > s.seq {
+		s.seq = h.Seq
+	}
+
+	if d.idle > 0 && now.Sub(d.pruned) > d.idle/2 {
+		d.pruned = now
+		for id, s := range d.sessions {
+			if now.Sub(s.seen) > d.idle {
+				delete(d.sessions, id)
+			}
+		}
+	}
+}
+
+// 记住的 session 数
+func (d *Dedup) Sessions() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.sessions)
+}
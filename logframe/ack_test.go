@@ -0,0 +1,134 @@
+package logframe_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+func TestAck(t *testing.T) {
+	var buf []byte
+	buf = logframe.AppendAck(buf, 7, 100)
+	buf = logframe.AppendAck(buf, 8, 1)
+	if len(buf) != 2*logframe.AckSize {
+		t.Fatalf("len = %d", len(buf))
+	}
+
+	r := bytes.NewReader(buf)
+	for _, want := range [][2]uint64{{7, 100}, {8, 1}} {
+		session, seq, err := logframe.ReadAck(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != want[0] || seq != want[1] {
+			t.Fatalf("got %d/%d, want %v", session, seq, want)
+		}
+	}
+
+	if _, _, err := logframe.ReadAck(bytes.NewReader(make([]byte, logframe.AckSize))); err != logframe.ErrBadFrame {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestFrameSeq(t *testing.T) {
+	h := logframe.Header{Flags: logframe.FlagSeq, App: "app", Logger: "billing"}
+	frame := logframe.AppendV2(nil, &h, []byte("record"))
+
+	if !logframe.SetFrameSeq(frame, 42, 9) {
+		t.Fatal("SetFrameSeq = false")
+	}
+	if session, seq, ok := logframe.FrameSeq(frame); !ok || session != 42 || seq != 9 {
+		t.Fatalf("FrameSeq = %d, %d, %v", session, seq, ok)
+	}
+
+	var f logframe.Frame
+	if err := logframe.NewDecoder(bytes.NewReader(frame), 1024).Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.Session != 42 || f.Header.Seq != 9 || f.Header.Logger != "billing" ||
+		string(f.Body) != "record" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	// 不带 FlagSeq
+	plain := logframe.AppendV2(nil, &logframe.Header{}, []byte("record"))
+	if logframe.SetFrameSeq(plain, 1, 1) {
+		t.Fatal("SetFrameSeq = true")
+	}
+	if _, _, ok := logframe.FrameSeq(plain); ok {
+		t.Fatal("FrameSeq ok = true")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	d := logframe.NewDedup(time.Hour)
+
+	h := logframe.Header{Flags: logframe.FlagSeq, Session: 1, Seq: 1}
+	if d.Duplicate(&h) {
+		t.Fatal("first frame is duplicate")
+	}
+	// 没有 Commit(写失败)时，重发的帧不算重复
+	if d.Duplicate(&h) {
+		t.Fatal("uncommitted frame is duplicate")
+	}
+	d.Commit(&h)
+	if !d.Duplicate(&h) {
+		t.Fatal("committed frame is not duplicate")
+	}
+
+	h.Seq = 5
+	d.Commit(&h)
+	for seq, dup := range map[uint64]bool{3: true, 5: true, 6: false} {
+		h.Seq = seq
+		if d.Duplicate(&h) != dup {
+			t.Fatalf("seq %d: duplicate = %v", seq, !dup)
+		}
+	}
+
+	// 别的 session 与不带 seq 的帧
+	if d.Duplicate(&logframe.Header{Flags: logframe.FlagSeq, Session: 2, Seq: 1}) ||
+		d.Duplicate(&logframe.Header{}) {
+		t.Fatal("unexpected duplicate")
+	}
+	if d.Sessions() != 1 {
+		t.Fatalf("sessions = %d", d.Sessions())
+	}
+}
+
+func TestDedupCheckAndCommit(t *testing.T) {
+	d := logframe.NewDedup(time.Hour)
+	h := logframe.Header{Flags: logframe.FlagSeq, Session: 1, Seq: 1}
+
+	// 写失败时不记下，重发的帧再处理一次
+	errWrite := errors.New("write failed")
+	if dup, err := d.CheckAndCommit(&h, func() error { return errWrite }); dup || err != errWrite {
+		t.Fatalf("dup=%v err=%v", dup, err)
+	}
+
+	// 两个连接同时收到同一帧，只处理一次
+	var processed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.CheckAndCommit(&h, func() error {
+				atomic.AddInt32(&processed, 1)
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if processed != 1 {
+		t.Fatalf("processed %d times", processed)
+	}
+	if dup, _ := d.CheckAndCommit(&h, func() error { return nil }); !dup {
+		t.Fatal("committed frame is not duplicate")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Package logframe 是 SocketHandler 与 logd 之间的帧格式，编码与解码。
+
+v1: 长度(uint32, 大端) + 日志
+
+	+--------+-----------+
+	| len 4B | body      |
+	+--------+-----------+
+
+v2: 带上日志的元数据，收集端不用解析日志内容就能知道来源
+
+	+----------+------------+----------+----------+-----------+--------+------+
+	| magic 1B | version 1B | flags 2B | hlen 2B  | blen 4B   | header | body |
+	+----------+------------+----------+----------+-----------+--------+------+
+
+	magic    0xEC。v1 的第一个字节是长度的最高字节，日志不会超过 3.6GB，所以不会冲突
+	version  2
+	flags    uint16 大端，FlagSeq: header 末尾带 session 与 seq(确认模式)，其它位保留
+	hlen     header 的长度，uint16 大端
+	blen     body 的长度，uint32 大端
+	header   依次为(整数都是大端):
+	             level        uint8   log4go 的 LevelTrace..LevelBuss
+	             content type uint8   ContentText / ContentJSON
+	             timestamp    int64   1970年至今的纳秒数
+	             pid          uint32
+	             hostname     uint8 长度 + 内容
+	             app          uint8 长度 + 内容
+	             logger       uint8 长度 + 内容
+	             session      uint64  flags 有 FlagSeq 时才有，发送端每次启动随机生成
+	             seq          uint64  flags 有 FlagSeq 时才有，同一 session 内从1递增
+	         字符串超过255字节时截断。
+	         hlen 比以上字段长时，多出来的部分忽略(以后扩展用)。
+	body     日志内容，与 v1 相同
+
+Decoder 可以同时解码 v1 与 v2，同一个连接里也可以混用。
+
+确认模式(参看 ack.go): 接收端处理完带 seq 的帧后，在同一个连接上回确认:
+
+	+----------+---------+------------+--------+
+	| magic 1B | 'A' 1B  | session 8B | seq 8B |
+	+----------+---------+------------+--------+
+
+	表示该 session 中 seq 及以前的帧都已收到(累计确认)。
+*/
+package logframe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	Magic    = 0xEC
+	Version1 = 1
+	Version2 = 2
+
+	V1HeaderSize = 4
+	V2PrefixSize = 10 // magic 到 blen
+)
+
+const (
+	ContentText = iota
+	ContentJSON
+)
+
+// flags
+const (
+	FlagSeq = 1 << 0
+)
+
+// header 中固定长度部分: level, content type, timestamp, pid
+const headerFixedSize = 1 + 1 + 8 + 4
+
+var (
+	ErrFrameTooLarge = errors.New("logframe: frame too large")
+	ErrBadFrame      = errors.New("logframe: bad frame")
+	ErrBadVersion    = errors.New("logframe: unsupported version")
+)
+
+type Header struct {
+	Level       uint8
+	ContentType uint8
+	Timestamp   time.Time
+	Pid         uint32
+	Hostname    string
+	App         string
+	Logger      string
+	Flags       uint16
+
+	// Flags 有 FlagSeq 时才编码
+	Session uint64
+	Seq     uint64
+}
+
+type Frame struct {
+	Version int
+	Header  Header // v1 时为零值
+	Body    []byte
+}
+
+// 追加一个 v1 帧
+func AppendV1(dst []byte, body []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(body)))
+	return append(dst, body...)
+}
+
+// 追加 v2 帧的头部(到 header 为止)，bodyLen 是随后 body 的长度
+func AppendV2Header(dst []byte, h *Header, bodyLen int) []byte {
+	start := len(dst)
+	dst = append(dst, Magic, Version2)
+	dst = binary.BigEndian.AppendUint16(dst, h.Flags)
+	dst = append(dst, 0, 0) // hlen，最后填
+	dst = binary.BigEndian.AppendUint32(dst, uint32(bodyLen))
+
+	hstart := len(dst)
+	dst = append(dst, h.Level, h.ContentType)
+	var ts int64
+	if !h.Timestamp.IsZero() {
+		ts = h.Timestamp.UnixNano()
+	}
+	dst = binary.BigEndian.AppendUint64(dst, uint64(ts))
+	dst = binary.BigEndian.AppendUint32(dst, h.Pid)
+	dst = appendString(dst, h.Hostname)
+	dst = appendString(dst, h.App)
+	dst = appendString(dst, h.Logger)
+	if h.Flags&FlagSeq != 0 {
+		dst = binary.BigEndian.AppendUint64(dst, h.Session)
+		dst = binary.BigEndian.AppendUint64(dst, h.Seq)
+	}
+
+	binary.BigEndian.PutUint16(dst[start+4:], uint16(len(dst)-hstart))
+	return dst
+}
+
+// 追加一个 v2 帧
+func AppendV2(dst []byte, h *Header, body []byte) []byte {
+	dst = AppendV2Header(dst, h, len(body))
+	return append(dst, body...)
+}
+
+// 先写头部、再写body，写完body后才知道长度时用：
+// start 是 AppendV2Header 之前 dst 的长度
+func SetV2BodyLen(frame []byte, start int, bodyLen int) {
+	binary.BigEndian.PutUint32(frame[start+6:], uint32(bodyLen))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	dst = append(dst, byte(len(s)))
+	return append(dst, s...)
+}
+
+// 解析 v2 的 header，h.Flags 要先设置好(在帧的前缀中)
+func ParseHeader(p []byte, h *Header) error {
+	if len(p) < headerFixedSize {
+		return ErrBadFrame
+	}
+	h.Level = p[0]
+	h.ContentType = p[1]
+	if ts := int64(binary.BigEndian.Uint64(p[2:])); ts != 0 {
+		h.Timestamp = time.Unix(0, ts)
+	} else {
+		h.Timestamp = time.Time{}
+	}
+	h.Pid = binary.BigEndian.Uint32(p[10:])
+	p = p[headerFixedSize:]
+
+	for _, s := range []*string{&h.Hostname, &h.App, &h.Logger} {
+		if len(p) < 1 || len(p) < 1+int(p[0]) {
+			return ErrBadFrame
+		}
+		*s = string(p[1 : 1+p[0]])
+		p = p[1+p[0]:]
+	}
+
+	h.Session, h.Seq = 0, 0
+	if h.Flags&FlagSeq != 0 {
+		if len(p) < 16 {
+			return ErrBadFrame
+		}
+		h.Session = binary.BigEndian.Uint64(p)
+		h.Seq = binary.BigEndian.Uint64(p[8:])
+	}
+	return nil
+}
+
+// Decoder 从流中读出 v1 或 v2 帧
+type Decoder struct {
+	r        *bufio.Reader
+	maxFrame int
+}
+
+// maxFrame 是 body 的最大长度，超过时返回 ErrFrameTooLarge，此后无法再分帧
+func NewDecoder(r io.Reader, maxFrame int) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, maxFrame: maxFrame}
+}
+
+// 读出一帧，f.Body 每次重新分配。流正常结束时返回 io.EOF
+func (d *Decoder) Decode(f *Frame) error {
+	first, err := d.r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if first[0] != Magic {
+		return d.decodeV1(f)
+	}
+	return d.decodeV2(f)
+}
+
+// 已经读到缓冲区、还没解码的字节数。为0时说明对方暂时没有更多数据，
+// 接收端可以趁这时回确认
+func (d *Decoder) Buffered() int {
+	return d.r.Buffered()
+}
+
+func (d *Decoder) decodeV1(f *Frame) error {
+	var prefix [V1HeaderSize]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n == 0 {
+		return ErrBadFrame
+	}
+	if n > uint32(d.maxFrame) {
+		return ErrFrameTooLarge
+	}
+
+	f.Version = Version1
+	f.Header = Header{}
+	return d.readBody(f, int(n))
+}
+
+func (d *Decoder) decodeV2(f *Frame) error {
+	var prefix [V2PrefixSize]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		return err
+	}
+	if prefix[1] != Version2 {
+		return ErrBadVersion
+	}
+
+	hlen := int(binary.BigEndian.Uint16(prefix[4:]))
+	blen := binary.BigEndian.Uint32(prefix[6:])
+	if blen == 0 {
+		return ErrBadFrame
+	}
+	if blen > uint32(d.maxFrame) {
+		return ErrFrameTooLarge
+	}
+
+	header := make([]byte, hlen)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return unexpected(err)
+	}
+
+	f.Version = Version2
+	f.Header.Flags = binary.BigEndian.Uint16(prefix[2:])
+	if err := ParseHeader(header, &f.Header); err != nil {
+		return err
+	}
+	return d.readBody(f, int(blen))
+}
+
+func (d *Decoder) readBody(f *Frame, n int) error {
+	f.Body = make([]byte, n)
+	if _, err := io.ReadFull(d.r, f.Body); err != nil {
+		return unexpected(err)
+	}
+	return nil
+}
+
+// 帧读了一半时的 EOF 是错误
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// p 是否正好是一个完整的 v2 帧
+func IsV2Frame(p []byte) bool {
+	if len(p) < V2PrefixSize || p[0] != Magic || p[1] != Version2 {
+		return false
+	}
+	hlen := int(binary.BigEndian.Uint16(p[4:]))
+	blen := int(binary.BigEndian.Uint32(p[6:]))
+	return len(p) == V2PrefixSize+hlen+blen
+}
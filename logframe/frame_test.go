@@ -0,0 +1,99 @@
+package logframe_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+func TestDecodeMixed(t *testing.T) {
+	now := time.Now()
+	h := logframe.Header{
+		Level:       3,
+		ContentType: logframe.ContentJSON,
+		Timestamp:   now,
+		Pid:         uint32(os.Getpid()),
+		Hostname:    "host-1",
+		App:         "app",
+		Logger:      "db",
+	}
+
+	var stream []byte
+	stream = logframe.AppendV1(stream, []byte("v1 record"))
+	stream = logframe.AppendV2(stream, &h, []byte(`{"msg":"v2 record"}`))
+
+	// 先写头部，body 写完后再填长度
+	start := len(stream)
+	stream = logframe.AppendV2Header(stream, &logframe.Header{App: "late"}, 0)
+	body := len(stream)
+	stream = append(stream, "late body"...)
+	logframe.SetV2BodyLen(stream, start, len(stream)-body)
+	if !logframe.IsV2Frame(stream[start:]) {
+		t.Fatal("IsV2Frame = false")
+	}
+
+	d := logframe.NewDecoder(bytes.NewReader(stream), 1024)
+	var f logframe.Frame
+
+	if err := d.Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != logframe.Version1 || string(f.Body) != "v1 record" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	if err := d.Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != logframe.Version2 || string(f.Body) != `{"msg":"v2 record"}` {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+	if f.Header.Level != 3 || f.Header.ContentType != logframe.ContentJSON ||
+		!f.Header.Timestamp.Equal(now) || f.Header.Pid != h.Pid ||
+		f.Header.Hostname != "host-1" || f.Header.App != "app" || f.Header.Logger != "db" {
+		t.Fatalf("unexpected header %+v", f.Header)
+	}
+
+	if err := d.Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.App != "late" || !f.Header.Timestamp.IsZero() || string(f.Body) != "late body" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	if err := d.Decode(&f); err != io.EOF {
+		t.Fatalf("err = %v, want EOF", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	v2 := logframe.AppendV2(nil, &logframe.Header{}, []byte("hello"))
+
+	cases := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"too large v1", logframe.AppendV1(nil, make([]byte, 9)), logframe.ErrFrameTooLarge},
+		{"too large v2", logframe.AppendV2(nil, &logframe.Header{}, make([]byte, 9)), logframe.ErrFrameTooLarge},
+		{"empty v1", logframe.AppendV1(nil, nil), logframe.ErrBadFrame},
+		{"bad version", append([]byte{logframe.Magic, 9}, v2[2:]...), logframe.ErrBadVersion},
+		{"short header", append(append([]byte(nil), v2[:logframe.V2PrefixSize]...), 0, 0, 0), io.ErrUnexpectedEOF},
+		{"short body", v2[:len(v2)-1], io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		var f logframe.Frame
+		err := logframe.NewDecoder(bytes.NewReader(c.frame), 8).Decode(&f)
+		if err != c.err {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	if logframe.IsV2Frame(v2[:len(v2)-1]) || logframe.IsV2Frame([]byte("hello world")) {
+		t.Fatal("IsV2Frame = true")
+	}
+}
@@ -71,6 +71,14 @@ PASS
 .....TestMain exit..... CPU= 4
 ok      wps.cn/lib/go/log       9.371s
 日志的处理能力： QPS=writeCnt=[1625968]/9.371s ~= 17万/s
+
+---- 邪恶之分隔线 ------------------------------------------------------------------------------
+IO线程增加环形队列(QueueTypeRing)后，与chan版本对比（结果与CPU核数、Go版本有关，请在目标机器上自行运行）：
+$ go test -bench=Queue -benchmem -run=none -benchtime=2s
+
+---- 邪恶之分隔线 ------------------------------------------------------------------------------
+Lfile 改用 runtime.Callers，并按PC缓存 file:[line] 后，对比 Lfile 开关的开销（结果与CPU核数、Go版本有关，请在目标机器上自行运行）：
+$ go test -bench=CallerFile -benchmem -run=none
 */
 package log4go_test
 
@@ -200,3 +208,64 @@ func BenchmarkTestMutilLogger(b *testing.B) {
 	// time.Sleep(time.Millisecond * 100)
 	wg.Wait()
 }
+
+// 对比 QueueTypeChan 与 QueueTypeRing 两种IO线程队列，
+// 多个goroutine同时写日志，drop% 为丢日志比例：
+//   go test -bench=Queue -benchmem -run=none
+func benchmarkIOThreadQueue(b *testing.B, queueType int) {
+	fd, err := log.NewFileHandler("/dev/null")
+	if err != nil {
+		panic(err.Error())
+	}
+	th := log.NewHandleIOWriteThreadWithQueue("benchQueue", 4096, queueType)
+	fd.SetWriteIOThread(th)
+	logger := log.NewLogger(fd, log.StdLogFlag)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			logger.Info("queue bench 9234905u3xcvjklxkj %s [%d]",
+				"02i34p[2o3ji4 lnxzckn kj sd;klfjsd", i)
+			i++
+		}
+	})
+	b.StopTimer()
+
+	th.Close()
+	fd.Close()
+
+	_, write, drop := th.Stat()
+	if sum := write + drop; sum > 0 {
+		b.ReportMetric(float64(drop)*100/float64(sum), "drop%")
+	}
+}
+
+func BenchmarkChanQueue(b *testing.B) {
+	benchmarkIOThreadQueue(b, log.QueueTypeChan)
+}
+
+func BenchmarkRingQueue(b *testing.B) {
+	benchmarkIOThreadQueue(b, log.QueueTypeRing)
+}
+
+// 只测调用方的开销(NullHandler不写)，对比有无 Lfile 时 runtime.Caller 解析的分配次数：
+//   go test -bench=CallerFile -benchmem -run=none
+func benchmarkCallerFile(b *testing.B, flag int) {
+	h, _ := log.NewNullHandler()
+	logger := log.NewLogger(h, flag)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logger.Info("caller file bench")
+	}
+}
+
+func BenchmarkCallerFileOff(b *testing.B) {
+	benchmarkCallerFile(b, log.Llevel)
+}
+
+func BenchmarkCallerFileOn(b *testing.B) {
+	benchmarkCallerFile(b, log.Llevel|log.Lfile)
+}
@@ -0,0 +1,128 @@
+package log4go
+
+import (
+	"fmt"
+	"sync"
+)
+
+//MemoryHandler keeps the latest Trace/Debug logs in memory, and writes them
+//out only when a log at or above the trigger level arrives.
+//
+//与python的 logging.handlers.MemoryHandler 类似：
+//平时 Trace/Debug 日志只放在容量为 capacity 的环形缓冲里，满了就丢弃最旧的；
+//Info 及以上的日志直接交给 target；
+//级别 >= trigger 的日志到来时，先把缓冲里的日志按顺序交给 target，再写这一条，
+//这样出错时能看到出错前的调试日志，平时又不用付出写调试日志的开销。
+//
+//注意 logger 的级别要设成 LevelTrace/LevelDebug，否则调试日志到不了这里。
+type MemoryHandler struct {
+	target   Handler
+	capacity int
+	trigger  int
+
+	mu   sync.Mutex
+	buf  []memoryRecord // 环形缓冲
+	head int            // 最旧一条的下标
+	n    int
+}
+
+type memoryRecord struct {
+	fmt Formatter
+	log *LogInstance
+}
+
+func NewMemoryHandler(capacity int, trigger int, target Handler) (*MemoryHandler, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("memory handler capacity must >0")
+	}
+	if target == nil {
+		return nil, fmt.Errorf("memory handler target is nil")
+	}
+	if trigger < LevelTrace || trigger >= len(LevelName) {
+		return nil, fmt.Errorf("invalid trigger level %d", trigger)
+	}
+
+	h := new(MemoryHandler)
+	h.target = target
+	h.capacity = capacity
+	h.trigger = trigger
+	h.buf = make([]memoryRecord, capacity)
+	return h, nil
+}
+
+func (h *MemoryHandler) AsyncWrite(fmt Formatter, log *LogInstance) {
+	if log.LevelNo <= LevelDebug && log.LevelNo < h.trigger {
+		h.push(fmt, log)
+		return
+	}
+
+	if log.LevelNo >= h.trigger {
+		h.Flush()
+	}
+	h.target.AsyncWrite(fmt, log)
+}
+
+func (h *MemoryHandler) push(fmt Formatter, log *LogInstance) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.n == h.capacity {
+		// 满了，丢弃最旧的
+		old := &h.buf[h.head]
+		old.log.Release()
+		*old = memoryRecord{fmt, log}
+		h.head = (h.head + 1) % h.capacity
+		return
+	}
+	h.buf[(h.head+h.n)%h.capacity] = memoryRecord{fmt, log}
+	h.n++
+}
+
+// 取出缓冲里的全部日志，按先后顺序
+func (h *MemoryHandler) take() []memoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.n == 0 {
+		return nil
+	}
+	records := make([]memoryRecord, h.n)
+	for i := range records {
+		idx := (h.head + i) % h.capacity
+		records[i] = h.buf[idx]
+		h.buf[idx] = memoryRecord{}
+	}
+	h.head, h.n = 0, 0
+	return records
+}
+
+// 把缓冲里的日志交给 target
+func (h *MemoryHandler) Flush() {
+	for _, r := range h.take() {
+		h.target.AsyncWrite(r.fmt, r.log)
+	}
+}
+
+// 缓冲的日志条数
+func (h *MemoryHandler) Buffered() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+func (h *MemoryHandler) Write(p []byte) (n int, err error) {
+	return h.target.Write(p)
+}
+
+// 写线程由 target 使用
+func (h *MemoryHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.target.SetWriteIOThread(th)
+}
+
+// 缓冲里没有触发的日志直接丢弃
+func (h *MemoryHandler) Close() error {
+	for _, r := range h.take() {
+		r.log.Release()
+	}
+	return h.target.Close()
+}
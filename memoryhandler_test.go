@@ -0,0 +1,56 @@
+package log4go_test
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func TestMemoryHandler(t *testing.T) {
+	buf := new(bytes.Buffer)
+	target, _ := log.NewStreamHandler(buf)
+	h, err := log.NewMemoryHandler(3, log.LevelError, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := log.NewHandleIOWriteThread("testMemoryHandler", 1024)
+	h.SetWriteIOThread(th)
+
+	logger := log.NewLogger(h, log.Llevel)
+	logger.SetLevel(log.LevelTrace)
+
+	for i := 0; i < 5; i++ {
+		logger.Debug("debug %d", i)
+	}
+	logger.Info("info")
+	if n := h.Buffered(); n != 3 {
+		t.Fatalf("buffered=%d", n)
+	}
+
+	logger.Error("failed")
+	logger.Trace("after")
+	logger.Close() // 关闭target与IO线程，没触发的 "after" 被丢弃
+
+	want := "INFO - info\n" +
+		"DEBUG - debug 2\n" +
+		"DEBUG - debug 3\n" +
+		"DEBUG - debug 4\n" +
+		"ERROR - failed\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected output: %q", got)
+	}
+	if n := h.Buffered(); n != 0 {
+		t.Fatalf("buffered=%d after close", n)
+	}
+}
+
+func TestMemoryHandlerInvalid(t *testing.T) {
+	target, _ := log.NewNullHandler()
+	if _, err := log.NewMemoryHandler(0, log.LevelError, target); err == nil {
+		t.Fatal("expect error for capacity 0")
+	}
+	if _, err := log.NewMemoryHandler(10, log.LevelError, nil); err == nil {
+		t.Fatal("expect error for nil target")
+	}
+}
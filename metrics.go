@@ -0,0 +1,415 @@
+/*
+日志管道的统计数据：
+
+	每个 HandleIOWriteThread 都会统计：按级别的写入数、每个handler写入的字节数、
+	队列长度与最高水位、format出错数、handler写出错数、入队到写出的延迟分布。
+
+	log.Metrics()          返回所有IO线程的统计快照
+	log.MetricsHandler()   以普罗米修斯文本格式输出，可以挂在 /metrics 上：
+	    http.Handle("/metrics", log.MetricsHandler())
+	                       同名的IO线程合并成一个 thread label 输出
+*/
+package log4go
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟分布的桶上界
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+type LatencyHistogram struct {
+	Bounds []time.Duration // 每个桶的上界(包含)
+	Counts []int64         // 每个桶的数量(不累计)，最后一个是 +Inf
+	Sum    time.Duration
+	Count  int64
+}
+
+type IOThreadMetrics struct {
+	Name    string
+	Written int64
+	Dropped int64
+
+	// 按级别统计写入数，key 为 LevelName
+	Levels map[string]int64
+
+	QueueLen       int
+	QueueCap       int
+	QueueHighWater int64
+
+	FormatErrors int64
+	WriteErrors  int64
+
+	// 每个handler写入的字节数，key 参看 handlerLabel()
+	HandlerBytes map[string]int64
+
+	// 入队到写出handler的延迟
+	Latency LatencyHistogram
+}
+
+type handlerBytes struct {
+	label string
+	n     int64
+}
+
+// 只有IO线程写，其它goroutine读，所以全部用原子操作
+type ioThreadMetrics struct {
+	levels       [len(LevelName)]int64
+	highWater    int64
+	formatErrors int64
+	writeErrors  int64
+
+	handlerBytes sync.Map // Handler => *handlerBytes
+
+	latency    [len(latencyBuckets) + 1]int64
+	latencySum int64
+	latencyCnt int64
+}
+
+func (m *ioThreadMetrics) observeLevel(level int) {
+	if level >= 0 && level < len(m.levels) {
+		atomic.AddInt64(&m.levels[level], 1)
+	}
+}
+
+func (m *ioThreadMetrics) observeQueueLen(n int) {
+	for {
+		hw := atomic.LoadInt64(&m.highWater)
+		if int64(n) <= hw ||
+			atomic.CompareAndSwapInt64(&m.highWater, hw, int64(n)) {
+			return
+		}
+	}
+}
+
+func (m *ioThreadMetrics) observeWrite(h Handler, n int, err error,
+	enqueue []int64) {
+
+	if err != nil {
+		atomic.AddInt64(&m.writeErrors, 1)
+	}
+
+	if n > 0 {
+		v, ok := m.handlerBytes.Load(h)
+		if !ok {
+			v, _ = m.handlerBytes.LoadOrStore(h,
+				&handlerBytes{label: handlerLabel(h)})
+		}
+		atomic.AddInt64(&v.(*handlerBytes).n, int64(n))
+	}
+
+	now := time.Now().UnixNano()
+	for _, t := range enqueue {
+		if t == 0 {
+			continue
+		}
+		d := time.Duration(now - t)
+		i := sort.Search(len(latencyBuckets), func(i int) bool {
+			return d <= latencyBuckets[i]
+		})
+		atomic.AddInt64(&m.latency[i], 1)
+		atomic.AddInt64(&m.latencySum, int64(d))
+		atomic.AddInt64(&m.latencyCnt, 1)
+	}
+}
+
+// 统计里handler的名字：文件类用文件名，socket用地址，其它用 类型@指针
+func handlerLabel(h Handler) string {
+	switch x := h.(type) {
+	case *FileHandler:
+		return "file:" + x.fileName
+	case *RotatingFileHandler:
+		return "file:" + x.fileName
+	case *TimeRotatingFileHandler:
+		return "file:" + x.baseName
+	case *SocketHandler:
+		if x.tlsConfig != nil {
+			return "tls+" + x.protocol + "://" + x.addr
+		}
+		return x.protocol + "://" + x.addr
+	case *socketEndpoint:
+		return handlerLabel(x.h)
+	case *HTTPHandler:
+		return x.label
+	case *SyslogHandler:
+		return "syslog:" + x.network + "://" + x.addr
+	}
+	return fmt.Sprintf("%T@%p", h, h)
+}
+
+// 去掉地址中的用户名密码与查询参数(可能带token)，只留 scheme://host/path
+func httpLabel(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "http:invalid-url"
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+func (self *HandleIOWriteThread) Metrics() IOThreadMetrics {
+	m := &self.metrics
+
+	s := IOThreadMetrics{
+		Name:           self.name,
+		Written:        atomic.LoadInt64(&self.writeCnt),
+		Dropped:        atomic.LoadInt64(&self.dropCnt),
+		Levels:         make(map[string]int64, len(LevelName)),
+		QueueLen:       self.queue.len(),
+		QueueCap:       self.queue.cap(),
+		QueueHighWater: atomic.LoadInt64(&m.highWater),
+		FormatErrors:   atomic.LoadInt64(&m.formatErrors),
+		WriteErrors:    atomic.LoadInt64(&m.writeErrors),
+		HandlerBytes:   make(map[string]int64),
+	}
+
+	for i, name := range LevelName {
+		s.Levels[name] = atomic.LoadInt64(&m.levels[i])
+	}
+
+	m.handlerBytes.Range(func(_, v interface{}) bool {
+		hb := v.(*handlerBytes)
+		s.HandlerBytes[hb.label] += atomic.LoadInt64(&hb.n)
+		return true
+	})
+
+	s.Latency.Bounds = latencyBuckets[:]
+	s.Latency.Counts = make([]int64, len(m.latency))
+	for i := range m.latency {
+		s.Latency.Counts[i] = atomic.LoadInt64(&m.latency[i])
+	}
+	s.Latency.Sum = time.Duration(atomic.LoadInt64(&m.latencySum))
+	s.Latency.Count = atomic.LoadInt64(&m.latencyCnt)
+
+	return s
+}
+
+//----------- 所有IO线程 ------------------------
+
+var ioThreads struct {
+	sync.Mutex
+	list []*HandleIOWriteThread
+}
+
+func registerIOThread(th *HandleIOWriteThread) {
+	ioThreads.Lock()
+	ioThreads.list = append(ioThreads.list, th)
+	ioThreads.Unlock()
+}
+
+func unregisterIOThread(th *HandleIOWriteThread) {
+	ioThreads.Lock()
+	defer ioThreads.Unlock()
+	for i, t := range ioThreads.list {
+		if t == th {
+			ioThreads.list = append(ioThreads.list[:i], ioThreads.list[i+1:]...)
+			return
+		}
+	}
+}
+
+func allIOThreads() []*HandleIOWriteThread {
+	ioThreads.Lock()
+	defer ioThreads.Unlock()
+	return append([]*HandleIOWriteThread(nil), ioThreads.list...)
+}
+
+// 所有未Close的IO线程的统计
+func Metrics() []IOThreadMetrics {
+	threads := allIOThreads()
+	ms := make([]IOThreadMetrics, len(threads))
+	for i, th := range threads {
+		ms[i] = th.Metrics()
+	}
+	return ms
+}
+
+//----------- 普罗米修斯文本格式 ------------------------
+
+type metricsHandler struct{}
+
+func MetricsHandler() http.Handler {
+	return metricsHandler{}
+}
+
+func (metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writePrometheus(bw, Metrics())
+	bw.Flush()
+}
+
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func (p promWriter) header(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p promWriter) sample(name string, v float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			p.w.WriteString(labels[i])
+			p.w.WriteString(`="`)
+			p.w.WriteString(promLabelEscaper.Replace(labels[i+1]))
+			p.w.WriteByte('"')
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteByte(' ')
+	p.w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 把统计以普罗米修斯文本格式(0.0.4)写到w
+// 同名的IO线程(如 NewHandleIOWriteThread 用了相同的name)合并成一个，
+// 否则同一组label会输出多个样本。计数相加，最高水位取最大值
+func mergeByName(ms []IOThreadMetrics) []IOThreadMetrics {
+	merged := make([]IOThreadMetrics, 0, len(ms))
+	index := make(map[string]int, len(ms))
+	for i := range ms {
+		j, ok := index[ms[i].Name]
+		if !ok {
+			// 复制map与切片，合并时不改 ms 中的
+			m := ms[i]
+			m.Levels = copyCounts(m.Levels)
+			m.HandlerBytes = copyCounts(m.HandlerBytes)
+			m.Latency.Counts = append([]int64(nil), m.Latency.Counts...)
+			index[m.Name] = len(merged)
+			merged = append(merged, m)
+			continue
+		}
+
+		m, o := &merged[j], &ms[i]
+		m.Written += o.Written
+		m.Dropped += o.Dropped
+		m.QueueLen += o.QueueLen
+		m.QueueCap += o.QueueCap
+		if o.QueueHighWater > m.QueueHighWater {
+			m.QueueHighWater = o.QueueHighWater
+		}
+		m.FormatErrors += o.FormatErrors
+		m.WriteErrors += o.WriteErrors
+		for k, v := range o.Levels {
+			m.Levels[k] += v
+		}
+		for k, v := range o.HandlerBytes {
+			m.HandlerBytes[k] += v
+		}
+		for k, c := range o.Latency.Counts {
+			m.Latency.Counts[k] += c
+		}
+		m.Latency.Sum += o.Latency.Sum
+		m.Latency.Count += o.Latency.Count
+	}
+	return merged
+}
+
+func copyCounts(src map[string]int64) map[string]int64 {
+	dst := make(map[string]int64, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func writePrometheus(w *bufio.Writer, ms []IOThreadMetrics) {
+	p := promWriter{w}
+	ms = mergeByName(ms)
+
+	counter := func(name, help string, get func(m *IOThreadMetrics) int64) {
+		p.header(name, "counter", help)
+		for i := range ms {
+			p.sample(name, float64(get(&ms[i])), "thread", ms[i].Name)
+		}
+	}
+	gauge := func(name, help string, get func(m *IOThreadMetrics) int64) {
+		p.header(name, "gauge", help)
+		for i := range ms {
+			p.sample(name, float64(get(&ms[i])), "thread", ms[i].Name)
+		}
+	}
+
+	counter("log4go_written_total", "Records formatted by the IO thread.",
+		func(m *IOThreadMetrics) int64 { return m.Written })
+	counter("log4go_dropped_total", "Records dropped by the IO thread.",
+		func(m *IOThreadMetrics) int64 { return m.Dropped })
+	counter("log4go_format_errors_total", "Formatter errors.",
+		func(m *IOThreadMetrics) int64 { return m.FormatErrors })
+	counter("log4go_write_errors_total", "Handler write errors.",
+		func(m *IOThreadMetrics) int64 { return m.WriteErrors })
+	gauge("log4go_queue_length", "Records waiting in the queue.",
+		func(m *IOThreadMetrics) int64 { return int64(m.QueueLen) })
+	gauge("log4go_queue_capacity", "Queue capacity.",
+		func(m *IOThreadMetrics) int64 { return int64(m.QueueCap) })
+	gauge("log4go_queue_high_water", "Max queue length ever seen.",
+		func(m *IOThreadMetrics) int64 { return m.QueueHighWater })
+
+	p.header("log4go_level_written_total", "counter", "Records written per level.")
+	for i := range ms {
+		for _, name := range LevelName {
+			p.sample("log4go_level_written_total", float64(ms[i].Levels[name]),
+				"thread", ms[i].Name, "level", name)
+		}
+	}
+
+	p.header("log4go_handler_written_bytes_total", "counter", "Bytes written per handler.")
+	for i := range ms {
+		labels := make([]string, 0, len(ms[i].HandlerBytes))
+		for label := range ms[i].HandlerBytes {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			p.sample("log4go_handler_written_bytes_total",
+				float64(ms[i].HandlerBytes[label]),
+				"thread", ms[i].Name, "handler", label)
+		}
+	}
+
+	const hist = "log4go_write_latency_seconds"
+	p.header(hist, "histogram", "Latency from enqueue to handler write.")
+	for i := range ms {
+		lh := &ms[i].Latency
+		var cum int64
+		for j, c := range lh.Counts {
+			cum += c
+			le := "+Inf"
+			if j < len(lh.Bounds) {
+				le = strconv.FormatFloat(lh.Bounds[j].Seconds(), 'g', -1, 64)
+			}
+			p.sample(hist+"_bucket", float64(cum), "thread", ms[i].Name, "le", le)
+		}
+		p.sample(hist+"_sum", lh.Sum.Seconds(), "thread", ms[i].Name)
+		p.sample(hist+"_count", float64(lh.Count), "thread", ms[i].Name)
+	}
+}
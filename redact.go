@@ -0,0 +1,247 @@
+/*
+敏感信息脱敏：
+
+	r := log.NewRedactor(log.RedactMask)
+	r.AddKeys("password", "*token*", "id_card")       // Fields 的key，glob写法，不区分大小写
+	r.AddRule(log.RedactRuleCardNumber)                // 正则，作用于msg与string等类型的Fields值，参看 Redactor
+	r.AddRule(`mobile=(\d+)`)                          // 有分组时只替换第1个分组
+	logger.SetRedactor(r)
+
+	脱敏在IO线程中、Formatter 之前进行，TxtLineFormatter 与 JSONFormatter 的输出都是脱敏后的。
+	Fields 需要脱敏时会复制一份，不会修改logger自己的Fields。
+*/
+package log4go
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// 替换方式
+const (
+	RedactMask = iota // 替换为掩码，默认 "******"
+	RedactHash        // 替换为 "hmac:" + HMAC-SHA256 的前16位hex，相同的值结果相同，方便关联查询；要 SetHashKey
+)
+
+// 常用的规则
+const (
+	// 13~19位的银行卡号，允许空格或-分隔，只替换通过Luhn校验的
+	// (时间戳、订单号之类的长数字一般通不过)
+	RedactRuleCardNumber = `\b\d(?:[ -]?\d){12,18}\b`
+	// 18位身份证号
+	RedactRuleIDNumber = `\b\d{17}[\dXx]\b`
+	// password=xxx, token: xxx 之类
+	RedactRuleSecret = `(?i)(?:password|passwd|pwd|token|secret)["']?\s*[:=]\s*["']?([^\s"'&,;]+)`
+)
+
+const defaultRedactMask = "******"
+
+// Redactor 只处理 msg，以及 Fields 中 string、[]byte、error、fmt.Stringer 类型的值；
+// 数字(如 int64 的用户ID、卡号)、结构体等其它类型不按规则扫描，
+// 需要脱敏时用 AddKeys 按key整个替换，或者写日志前自己转成 string。
+type Redactor struct {
+	mode    int
+	mask    string
+	hashKey []byte
+	keys    []string
+	rules   []redactRule
+}
+
+type redactRule struct {
+	re    *regexp.Regexp
+	check func(s string) bool // 不为nil时，只替换check为true的匹配
+}
+
+func NewRedactor(mode int) *Redactor {
+	return &Redactor{mode: mode, mask: defaultRedactMask}
+}
+
+func (r *Redactor) SetMask(mask string) {
+	r.mask = mask
+}
+
+// RedactHash 的密钥。卡号、手机号之类的取值范围很小，不加密钥的hash可以离线穷举出原值，
+// 所以没有设置密钥时 RedactHash 也替换为掩码。密钥要保密，换了密钥以后结果就对不上了
+func (r *Redactor) SetHashKey(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("redact hash key is empty")
+	}
+	r.hashKey = append([]byte(nil), key...)
+	return nil
+}
+
+// Fields 中key匹配任一pattern的值整个替换，pattern 为 path.Match 的写法
+func (r *Redactor) AddKeys(patterns ...string) error {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+		r.keys = append(r.keys, p)
+	}
+	return nil
+}
+
+func (r *Redactor) AddRule(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	rule := redactRule{re: re}
+	if expr == RedactRuleCardNumber {
+		rule.check = luhnValid
+	}
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+func (r *Redactor) replacement(s string) string {
+	if r.mode == RedactHash && len(r.hashKey) > 0 {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(s))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return r.mask
+}
+
+func (r *Redactor) matchKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, p := range r.keys {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 按规则替换字符串
+func (r *Redactor) RedactString(s string) string {
+	for _, rule := range r.rules {
+		s = r.redactRule(rule, s)
+	}
+	return s
+}
+
+func (r *Redactor) redactRule(rule redactRule, s string) string {
+	matches := rule.re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			// 只替换第1个分组
+			start, end = m[2], m[3]
+		}
+		if rule.check != nil && !rule.check(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.replacement(s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Luhn 校验，忽略数字以外的字符
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// 返回脱敏后的Fields，没有需要替换的时返回原map
+func (r *Redactor) redactFields(kv Fields) Fields {
+	var out Fields
+	for k, v := range kv {
+		var nv string
+		if r.matchKey(k) {
+			s, ok := v.(string)
+			if !ok {
+				s = fmt.Sprint(v)
+			}
+			nv = r.replacement(s)
+			if s, ok := v.(string); ok && s == nv {
+				continue
+			}
+		} else if s, ok := redactableString(v); ok {
+			// []byte 不能用 == 比较，只比较字符串
+			if nv = r.RedactString(s); nv == s {
+				continue
+			}
+		} else {
+			continue
+		}
+
+		if out == nil {
+			out = make(Fields, len(kv))
+			for kk, vv := range kv {
+				out[kk] = vv
+			}
+		}
+		out[k] = nv
+	}
+
+	if out == nil {
+		return kv
+	}
+	return out
+}
+
+// 按规则扫描的类型，参看 Redactor
+func redactableString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	case error:
+		return x.Error(), true
+	case fmt.Stringer:
+		return x.String(), true
+	}
+	return "", false
+}
+
+func (l *Logger) SetRedactor(r *Redactor) {
+	l.redactor = r
+}
+
+func SetRedactor(r *Redactor) { std.SetRedactor(r) }
+
+// Formatter 之前调用
+func (l *LogInstance) redact() {
+	r := l.redactor
+	if r == nil {
+		return
+	}
+	l.redactor = nil
+
+	l.Msg = r.RedactString(l.Msg)
+	if len(l.KV) > 0 {
+		l.KV = r.redactFields(l.KV)
+	}
+}
@@ -0,0 +1,116 @@
+package log4go_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func TestRedactor(t *testing.T) {
+	r := log.NewRedactor(log.RedactMask)
+	if err := r.AddKeys("password", "*token*"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{
+		log.RedactRuleCardNumber,
+		log.RedactRuleIDNumber,
+		log.RedactRuleSecret,
+	} {
+		if err := r.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// txt 格式
+	logger, buf, th := newBufferLogger("testRedactTxt")
+	logger.SetRedactor(r)
+	logger.Info("card=6222 0212 3456 7890 128 id=11010519491231002X password=abc123 ok")
+	th.Close()
+
+	expect := "card=****** id=****** password=****** ok\n"
+	if buf.String() != expect {
+		t.Fatalf("expect %q, got %q", expect, buf.String())
+	}
+
+	// json 格式, Fields 也要脱敏，但不能修改logger自己的Fields
+	logger, buf, th = newBufferLogger("testRedactJSON")
+	logger.SetRedactor(r)
+	jl := logger.WithFields(log.Fields{
+		"password":     "abc123",
+		"access_Token": "xyz",
+		"note":         "card 6222021234567890128",
+		"uid":          42,
+	})
+	jl.Info("login")
+	th.Close()
+
+	out := buf.String()
+	for _, leak := range []string{"abc123", "xyz", "6222021234567890128"} {
+		if strings.Contains(out, leak) {
+			t.Fatalf("%q leaked in %s", leak, out)
+		}
+	}
+	if !strings.Contains(out, `"uid":42`) || !strings.Contains(out, `"note":"card ******"`) {
+		t.Fatalf("unexpected json: %s", out)
+	}
+
+	// 通不过Luhn校验的长数字(如毫秒时间戳)不是卡号
+	msg := "ts=1700000000123 card=6222021234567890128"
+	if got := r.RedactString(msg); got != "ts=1700000000123 card=******" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	r := log.NewRedactor(log.RedactHash)
+	r.AddRule(`token=(\w+)`)
+
+	// 没有密钥时不hash，只用掩码
+	if got := r.RedactString("token=abc"); got != "token=******" {
+		t.Fatalf("got %q", got)
+	}
+	if err := r.SetHashKey(nil); err == nil {
+		t.Fatal("expect empty key error")
+	}
+
+	r.SetHashKey([]byte("secret"))
+	a := r.RedactString("token=abc")
+	b := r.RedactString("token=abc")
+	if a != b || !strings.HasPrefix(a, "token=hmac:") || strings.Contains(a, "abc") {
+		t.Fatalf("a=%q b=%q", a, b)
+	}
+
+	// 密钥不同，结果不同
+	r2 := log.NewRedactor(log.RedactHash)
+	r2.AddRule(`token=(\w+)`)
+	r2.SetHashKey([]byte("other"))
+	if c := r2.RedactString("token=abc"); c == a {
+		t.Fatalf("same hash %q with different keys", c)
+	}
+}
+
+type testStringer string
+
+func (s testStringer) String() string { return string(s) }
+
+// []byte、error、fmt.Stringer 类型的 Fields 也按规则扫描
+func TestRedactFieldTypes(t *testing.T) {
+	r := log.NewRedactor(log.RedactMask)
+	r.AddRule(log.RedactRuleCardNumber)
+
+	logger, buf, th := newBufferLogger("testRedactTypes")
+	logger.SetRedactor(r)
+	logger.WithFields(log.Fields{
+		"bytes":    []byte("card 6222021234567890128"),
+		"stringer": testStringer("card 6222021234567890128"),
+		"err":      fmt.Errorf("card 6222021234567890128"),
+		"plain":    []byte("nothing"),
+	}).Info("x")
+	th.Close()
+
+	if out := buf.String(); strings.Contains(out, "6222021234567890128") {
+		t.Fatalf("leaked in %s", out)
+	}
+}
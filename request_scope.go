@@ -0,0 +1,126 @@
+/*
+按请求缓冲日志，请求结束时再决定输出哪些：
+
+	func (s *Server) Handle(req *Request) (err error) {
+	    logger := s.logger.BeginRequest(500*time.Millisecond, 0).
+	        WithField("req_id", req.ID)
+	    logger.SetLevel(log.LevelDebug)  // 按需，让调试日志也进缓冲
+	    defer func() { logger.EndRequest(err) }()
+
+	    logger.Debug("...")
+	    ...
+	}
+
+	请求内的日志先放在缓冲里，不进IO线程；EndRequest 时：
+	    请求失败(err != nil)或者超过 slow 的慢请求，缓冲的日志全部输出；
+	    否则只输出 Info 及以上的日志，其它丢弃。
+
+	BeginRequest 返回的logger，以及由它 WithField/WithFields 派生的logger，共用同一个缓冲。
+	延迟格式化时，带 log.Safe 参数的日志进缓冲时就格式化好msg，缓冲不持有 Safe 的值，
+	调用方不用保证它们在整个请求期间不变。
+	缓冲满了以后，Info 及以上的日志直接输出，更低级别的丢弃。
+	EndRequest 之后再用这些logger，日志直接输出。
+*/
+package log4go
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultRequestBufferSize = 1000
+
+type scopeRecord struct {
+	logger *Logger
+	log    *LogInstance
+	rec    *FilterRecord
+}
+
+type requestScope struct {
+	start time.Time
+	slow  time.Duration
+	max   int
+
+	mu      sync.Mutex
+	records []scopeRecord
+	dropped int
+	ended   bool
+}
+
+// 开始一个请求，返回带缓冲的logger。
+// slow<=0 表示不按耗时判断；maxRecords<=0 时用 DefaultRequestBufferSize。
+func (l *Logger) BeginRequest(slow time.Duration, maxRecords int) *Logger {
+	if maxRecords <= 0 {
+		maxRecords = DefaultRequestBufferSize
+	}
+
+	ll := l.clone()
+	ll.formatter = l.formatter
+	ll.scope = &requestScope{
+		start: time.Now(),
+		slow:  slow,
+		max:   maxRecords,
+	}
+	return ll
+}
+
+// 结束请求，输出缓冲的日志。不是由 BeginRequest 得到的logger调用时什么都不做。
+func (l *Logger) EndRequest(err error) {
+	s := l.scope
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	records := s.records
+	s.records = nil
+	s.mu.Unlock()
+
+	all := err != nil || (s.slow > 0 && time.Since(s.start) >= s.slow)
+	for _, r := range records {
+		if all || r.log.LevelNo >= LevelInfo {
+			r.logger.dispatch(r.log, r.rec)
+		} else {
+			r.log.Release()
+		}
+	}
+}
+
+// 请求内被丢弃(缓冲满)的日志条数
+func (l *Logger) RequestDropped() int {
+	if l.scope == nil {
+		return 0
+	}
+	l.scope.mu.Lock()
+	defer l.scope.mu.Unlock()
+	return l.scope.dropped
+}
+
+// 返回true表示日志已经由缓冲接管
+func (s *requestScope) add(l *Logger, log *LogInstance, rec *FilterRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return false
+	}
+	if len(s.records) < s.max {
+		if log.safeArgs {
+			// Safe 的值只保证到日志写出为止，不能一直留到 EndRequest
+			log.resolveMsg()
+		}
+		s.records = append(s.records, scopeRecord{l, log, rec})
+		return true
+	}
+	if log.LevelNo >= LevelInfo {
+		return false
+	}
+	s.dropped++
+	log.Release()
+	return true
+}
@@ -0,0 +1,80 @@
+package log4go_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func TestRequestScope(t *testing.T) {
+	logger, buf, th := newBufferLogger("testRequestScope")
+
+	// 成功的请求只输出 Info 及以上
+	ok := logger.BeginRequest(time.Hour, 0).WithField("req", 1)
+	ok.Debug("ok debug")
+	ok.Info("ok info")
+	if buf.Len() != 0 {
+		t.Fatalf("records written before request end: %q", buf.String())
+	}
+	ok.EndRequest(nil)
+
+	// 失败的请求全部输出
+	failed := logger.BeginRequest(time.Hour, 0)
+	failed.WithField("req", 2).Debug("failed debug")
+	failed.Error("failed error")
+	failed.EndRequest(errors.New("boom"))
+	failed.Trace("after end") // 请求结束后直接输出
+
+	// 慢请求全部输出
+	slow := logger.BeginRequest(time.Millisecond, 0)
+	slow.Trace("slow trace")
+	time.Sleep(5 * time.Millisecond)
+	slow.EndRequest(nil)
+
+	// 缓冲满了: Info及以上直接输出，其它丢弃
+	full := logger.BeginRequest(0, 1)
+	full.Debug("full buffered")
+	full.Debug("full dropped")
+	full.Warn("full warn")
+	if n := full.RequestDropped(); n != 1 {
+		t.Fatalf("dropped=%d", n)
+	}
+	full.EndRequest(errors.New("boom"))
+
+	th.Close()
+
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"ok info", "failed debug", "failed error", "after end",
+		"slow trace", "full warn", "full buffered"}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Fatalf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if !strings.Contains(got[1], `"req":2`) {
+		t.Fatalf("fields lost: %q", got[1])
+	}
+}
+
+// 缓冲中的日志不持有 Safe 的值，请求期间修改不影响已经缓冲的日志
+func TestRequestScopeSafeArgs(t *testing.T) {
+	logger, buf, th := newBufferLogger("testRequestScopeSafe")
+	logger.SetDeferredFormat(true)
+
+	req := &struct{ State string }{"before"}
+	scoped := logger.BeginRequest(0, 0)
+	scoped.Info("req=%v", log.Safe(req))
+	req.State = "after"
+	scoped.EndRequest(nil)
+	th.Close()
+
+	if !strings.Contains(buf.String(), "req=&{before}") {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
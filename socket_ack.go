@@ -0,0 +1,333 @@
+package log4go
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+// 确认模式的默认窗口大小(没确认的帧数)与等待确认的超时
+const (
+	DEFAULT_SOCKET_ACK_WINDOW  = 4096
+	DEFAULT_SOCKET_ACK_TIMEOUT = 10 * time.Second
+)
+
+var errAckTimeout = errors.New("socket handler ack timeout")
+
+// 已发出、还没确认的帧
+type unackedFrame struct {
+	session uint64
+	seq     uint64
+	frame   []byte
+}
+
+// 确认模式(至少一次)，用于不能丢的日志(如计费的 Buss 日志)，对方要支持(如 cmd/logd)。
+// 自动使用 v2 帧格式，要在写日志之前调用，不支持报文模式。
+//
+// 每帧带上 session(每个 SocketHandler 随机生成)与递增的 seq，对方处理完后累计确认。
+// 没确认的帧留在内存窗口中，最多 window 帧：
+//   - 窗口满时IO线程等待确认，超过 timeout 认为连接已坏，断开重连；
+//   - 断线后，设置了 SetSpool 时窗口中的帧先存到spool，重连后和断线期间的日志一起按顺序重发，
+//     spool 中的分段全部确认后才删除；没有spool时重连后从内存中重发；
+//   - Close 时最多等 timeout 让窗口中的帧得到确认，还没确认的存到spool，下次启动后重发。
+//
+// 重发会导致对方收到重复的帧，对方按 session+seq 去重(logframe.Dedup)。
+// window/timeout <=0 时用默认值。
+func (h *SocketHandler) SetAck(window int, timeout time.Duration) error {
+	if h.datagram {
+		return fmt.Errorf("ack mode does not support protocol %q", h.protocol)
+	}
+	if window <= 0 {
+		window = DEFAULT_SOCKET_ACK_WINDOW
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_SOCKET_ACK_TIMEOUT
+	}
+
+	h.mu.Lock()
+	h.ack = true
+	h.ackWindow = window
+	h.ackTimeout = timeout
+	h.ackCond = sync.NewCond(&h.mu)
+	h.session = newAckSession()
+	frameV2 := h.frameV2
+	h.mu.Unlock()
+
+	if !frameV2 {
+		h.SetFrameV2("")
+	} else {
+		h.mu.Lock()
+		h.frameHeader.Flags |= logframe.FlagSeq
+		h.frameHeader.Session = h.session
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// 已发出还没确认的帧数
+func (h *SocketHandler) Unacked() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.unacked)
+}
+
+func newAckSession() uint64 {
+	return newDatagramMsgID()
+}
+
+// 复制一份带 seq 的帧。r 不是带 seq 的 v2 帧时重新编码
+func (h *SocketHandler) seqFrame(r []byte, seq uint64) []byte {
+	var frame []byte
+	if _, _, ok := logframe.FrameSeq(r); ok {
+		frame = append([]byte(nil), r...)
+	} else if logframe.IsV2Frame(r) {
+		var f logframe.Frame
+		logframe.NewDecoder(bytes.NewReader(r), len(r)).Decode(&f)
+		hdr := f.Header
+		hdr.Flags |= logframe.FlagSeq
+		frame = logframe.AppendV2(nil, &hdr, f.Body)
+	} else {
+		hdr := h.frameHeader
+		frame = logframe.AppendV2(nil, &hdr, r)
+	}
+	logframe.SetFrameSeq(frame, h.session, seq)
+	return frame
+}
+
+// 以下调用时都持有 h.mu
+
+func (h *SocketHandler) track(frame []byte) {
+	session, seq, _ := logframe.FrameSeq(frame)
+	h.unacked = append(h.unacked, unackedFrame{session, seq, frame})
+}
+
+func (h *SocketHandler) ackRoom() bool  { return len(h.unacked) < h.ackWindow }
+func (h *SocketHandler) allAcked() bool { return len(h.unacked) == 0 }
+
+// 对方确认了 session 中 seq 及以前的帧
+func (h *SocketHandler) onAck(session, seq uint64) {
+	j := 0
+	for _, u := range h.unacked {
+		if u.session == session && u.seq <= seq {
+			continue
+		}
+		h.unacked[j] = u
+		j++
+	}
+	if j == len(h.unacked) {
+		return
+	}
+	for i := j; i < len(h.unacked); i++ {
+		h.unacked[i] = unackedFrame{}
+	}
+	h.unacked = h.unacked[:j]
+	h.ackCond.Broadcast()
+}
+
+func (h *SocketHandler) clearUnacked() {
+	for i := range h.unacked {
+		h.unacked[i] = unackedFrame{}
+	}
+	h.unacked = h.unacked[:0]
+}
+
+// 断线后把窗口中的帧存到spool，保证和之后的日志的顺序。
+// 这时spool一定是空的：spool中有数据时不会是已连接状态。
+// 没有spool时留在内存中，重连后重发。
+func (h *SocketHandler) saveUnacked() {
+	if h.spool == nil {
+		return
+	}
+	for _, u := range h.unacked {
+		if err := h.spool.append(u.frame); err != nil {
+			reportInternalError(err)
+			break
+		}
+	}
+	h.clearUnacked()
+}
+
+// 等到 done() 为true。超时、连接 c 读确认出错或 handler 关闭时返回false
+func (h *SocketHandler) waitAck(c net.Conn, done func() bool) bool {
+	if done() {
+		return true
+	}
+
+	deadline := time.Now().Add(h.ackTimeout)
+	t := time.AfterFunc(h.ackTimeout, func() {
+		h.mu.Lock()
+		h.ackCond.Broadcast()
+		h.mu.Unlock()
+	})
+	defer t.Stop()
+
+	for !done() {
+		if h.state == sockClosed || h.ackConn != c || h.ackErr != nil ||
+			!time.Now().Before(deadline) {
+			return false
+		}
+		h.ackCond.Wait()
+	}
+	return true
+}
+
+// 已连接时写，窗口满了等确认
+func (h *SocketHandler) writeAcked(records [][]byte) (n int, err error) {
+	for len(records) > 0 {
+		c := h.c
+		ok := h.waitAck(c, h.ackRoom)
+
+		// 等待期间释放了 h.mu，连接可能已经断开(断开时窗口可能被清空，ok也为true)
+		switch {
+		case h.state == sockClosed:
+			return n, errSocketClosed
+		case h.state == sockConnected && h.c != c:
+			continue // 等待期间已经重连上了
+		case h.state != sockConnected:
+			m, err := h.spoolFrames(records, errSocketDisconnected)
+			return n + m, err
+		case !ok:
+			// 对方一直不确认，当作连接已坏
+			h.connLost(c)
+			m, err := h.spoolFrames(records, errAckTimeout)
+			return n + m, err
+		}
+
+		k := h.ackWindow - len(h.unacked)
+		if k > len(records) {
+			k = len(records)
+		}
+		bufs := h.bufs[:0]
+		for _, r := range records[:k] {
+			h.nextSeq++
+			frame := h.seqFrame(r, h.nextSeq)
+			h.track(frame)
+			bufs = append(bufs, frame)
+		}
+		h.bufs = bufs
+
+		vec := bufs
+		_, err = vec.WriteTo(c)
+		for i := range bufs {
+			bufs[i] = nil
+		}
+		n += k
+		records = records[k:]
+		if err != nil {
+			// 已经在窗口里了，重连后重发
+			h.connLost(c)
+			m, err := h.spoolFrames(records, err)
+			return n + m, err
+		}
+	}
+	return n, nil
+}
+
+// Close 前最多等 ackTimeout 让已发出的帧得到确认，还没确认的存到spool
+func (h *SocketHandler) drainUnacked() {
+	if h.state != sockConnected {
+		// 重连中窗口已经存到spool(或没有spool留在内存)；
+		// 重发中窗口里的是spool当前分段的帧
+		return
+	}
+	h.waitAck(h.c, h.allAcked)
+	h.saveUnacked()
+}
+
+//----------- 读确认 ------------------------
+
+func (h *SocketHandler) startAckReader(c net.Conn) {
+	h.ackConn = c
+	h.ackErr = nil
+	h.wg.Add(1)
+	go h.readAcks(c)
+}
+
+func (h *SocketHandler) readAcks(c net.Conn) {
+	defer h.wg.Done()
+
+	r := bufio.NewReader(c)
+	for {
+		session, seq, err := logframe.ReadAck(r)
+
+		h.mu.Lock()
+		if err != nil {
+			if h.ackConn == c {
+				h.ackErr = err
+			}
+			// 对方断开了，不用等到下次写出错
+			h.connLost(c)
+			h.ackCond.Broadcast()
+			h.mu.Unlock()
+			return
+		}
+		h.onAck(session, seq)
+		h.mu.Unlock()
+	}
+}
+
+//----------- 重连后重发 ------------------------
+
+// 重连后先重发内存窗口中的帧(没有spool时)，并开始读确认
+func (h *SocketHandler) resendUnacked(c net.Conn) bool {
+	h.mu.Lock()
+	h.startAckReader(c)
+	bufs := make(net.Buffers, 0, len(h.unacked))
+	for _, u := range h.unacked {
+		bufs = append(bufs, u.frame)
+	}
+	h.mu.Unlock()
+
+	if _, err := bufs.WriteTo(c); err != nil {
+		return h.replayFailed(c)
+	}
+	return true
+}
+
+// 把spool中一个分段的帧放进窗口发出，整个分段都确认了才返回
+func (h *SocketHandler) replayAcked(c net.Conn, data []byte) error {
+	var pending net.Buffers
+	for len(data) > 0 {
+		n := spoolFrameLen(data)
+		if n == 0 {
+			break // front 已经去掉了损坏的数据，不会到这里
+		}
+		frame := data[:n]
+		data = data[n:]
+
+		// 不带 seq 的帧(开启确认模式之前存的)直接发
+		if _, _, ok := logframe.FrameSeq(frame); ok {
+			h.mu.Lock()
+			if !h.ackRoom() {
+				h.mu.Unlock()
+				if _, err := pending.WriteTo(c); err != nil {
+					return err
+				}
+				h.mu.Lock()
+				if !h.waitAck(c, h.ackRoom) {
+					h.mu.Unlock()
+					return errAckTimeout
+				}
+			}
+			h.track(frame)
+			h.mu.Unlock()
+		}
+		pending = append(pending, frame)
+	}
+	if _, err := pending.WriteTo(c); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.waitAck(c, h.allAcked) {
+		return errAckTimeout
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+SocketHandler 的报文模式(protocol 为 udp/udp4/udp6/unixgram 时)：
+
+	每条日志一个报文，没有长度前缀。
+	超过 SetMaxPayload(默认 DEFAULT_DATAGRAM_MAX_PAYLOAD) 的日志切成多片，每片一个报文，
+	每片前面加上 DATAGRAM_CHUNK_HEADER_SIZE 字节的头(大端)：
+
+	    0x1e 0x0f | 消息ID uint64 | 片序号 uint16 | 总片数 uint16 | 数据
+
+	没有切片的报文就是日志本身(日志不会以 0x1e 开头)。
+	接收方可以用 DatagramReassembler 把切片还原成完整的日志。
+*/
+package log4go
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 以太网MTU 1500 减去 IP/UDP 头，再留点余量
+	DEFAULT_DATAGRAM_MAX_PAYLOAD = 1400
+	DATAGRAM_CHUNK_HEADER_SIZE   = 14
+	// 一条日志最多的切片数，接收方也按这个拒绝，免得一个伪造的头就分配很多内存
+	DATAGRAM_MAX_CHUNKS = 1024
+
+	// DatagramReassembler 默认最多同时拼 1024 条日志、缓存 16MB，超过时丢弃最早的
+	DEFAULT_DATAGRAM_MAX_PENDING  = 1024
+	DEFAULT_DATAGRAM_MAX_BUFFERED = 16 << 20
+)
+
+var datagramChunkMagic = [2]byte{0x1e, 0x0f}
+
+func isDatagramProtocol(protocol string) bool {
+	switch protocol {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// 报文的最大长度(包括切片头)，要在写日志之前调用
+func (h *SocketHandler) SetMaxPayload(n int) error {
+	if n <= DATAGRAM_CHUNK_HEADER_SIZE {
+		return fmt.Errorf("max payload must >%d", DATAGRAM_CHUNK_HEADER_SIZE)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxPayload = n
+	return nil
+}
+
+// 每条日志发一个报文，太大的切片发送。返回发送成功的条数。
+func (h *SocketHandler) writeDatagrams(records [][]byte) (n int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state == sockClosed {
+		return 0, errSocketClosed
+	}
+	if err = h.connect(); err != nil {
+		return
+	}
+
+	for _, r := range records {
+		if h.frameV2 {
+			r = h.frameRecord(r)
+		}
+		if err = h.sendDatagram(r); err != nil {
+			h.c.Close()
+			h.c = nil
+			return
+		}
+		n++
+	}
+	return
+}
+
+func (h *SocketHandler) sendDatagram(r []byte) error {
+	if len(r) <= h.maxPayload && (len(r) == 0 || r[0] != datagramChunkMagic[0]) {
+		_, err := h.c.Write(r)
+		return err
+	}
+
+	size := h.maxPayload - DATAGRAM_CHUNK_HEADER_SIZE
+	count := (len(r) + size - 1) / size
+	if count > DATAGRAM_MAX_CHUNKS {
+		return fmt.Errorf("log too large for datagram: %d bytes", len(r))
+	}
+
+	if cap(h.chunk) < h.maxPayload {
+		h.chunk = make([]byte, h.maxPayload)
+	}
+	chunk := h.chunk[:h.maxPayload]
+	copy(chunk, datagramChunkMagic[:])
+	binary.BigEndian.PutUint64(chunk[2:], atomic.AddUint64(&h.msgID, 1))
+	binary.BigEndian.PutUint16(chunk[12:], uint16(count))
+
+	for i := 0; i < count; i++ {
+		data := r[i*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+		binary.BigEndian.PutUint16(chunk[10:], uint16(i))
+		m := copy(chunk[DATAGRAM_CHUNK_HEADER_SIZE:], data)
+		if _, err := h.c.Write(chunk[:DATAGRAM_CHUNK_HEADER_SIZE+m]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 消息ID的起始值随机，避免多个进程发往同一个接收方时冲突
+func newDatagramMsgID() uint64 {
+	return uint64(rand.Int63())<<1 ^ uint64(time.Now().UnixNano())
+}
+
+//----------- 接收方 ------------------------
+
+// DatagramReassembler 把切片的报文还原成完整的日志，可以并发使用。
+// 超过 timeout 还没收齐的日志会被丢弃；
+// 没收齐的日志超过 SetLimits 的条数或字节数时，丢弃最早开始的。
+type DatagramReassembler struct {
+	timeout     time.Duration
+	maxPending  int
+	maxBuffered int
+
+	mu       sync.Mutex
+	partials map[uint64]*datagramPartial
+	order    *list.List // 按第一个切片到达的顺序，元素为消息ID
+	buffered int        // 所有没收齐的日志占用的字节数(包括切片表)
+	lastGC   time.Time
+}
+
+type datagramPartial struct {
+	chunks   [][]byte
+	received int
+	size     int // 已收到的数据，加上切片表的大小
+	first    time.Time
+	elem     *list.Element
+}
+
+// 切片表中每一项的大小，也算在缓存的字节数里
+const datagramSliceHeaderSize = 24
+
+func NewDatagramReassembler(timeout time.Duration) *DatagramReassembler {
+	return &DatagramReassembler{
+		timeout:     timeout,
+		maxPending:  DEFAULT_DATAGRAM_MAX_PENDING,
+		maxBuffered: DEFAULT_DATAGRAM_MAX_BUFFERED,
+		partials:    make(map[uint64]*datagramPartial),
+		order:       list.New(),
+		lastGC:      time.Now(),
+	}
+}
+
+// 没收齐的日志最多 maxPending 条、maxBuffered 字节，<=0 时用默认值
+func (r *DatagramReassembler) SetLimits(maxPending, maxBuffered int) {
+	if maxPending <= 0 {
+		maxPending = DEFAULT_DATAGRAM_MAX_PENDING
+	}
+	if maxBuffered <= 0 {
+		maxBuffered = DEFAULT_DATAGRAM_MAX_BUFFERED
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxPending = maxPending
+	r.maxBuffered = maxBuffered
+}
+
+// 收到一个报文。返回完整的日志时 ok 为true；切片还没收齐时返回 nil, false。
+// 没有切片的报文原样返回。
+func (r *DatagramReassembler) Add(packet []byte) (record []byte, ok bool) {
+	if len(packet) < DATAGRAM_CHUNK_HEADER_SIZE ||
+		packet[0] != datagramChunkMagic[0] || packet[1] != datagramChunkMagic[1] {
+		return packet, true
+	}
+
+	id := binary.BigEndian.Uint64(packet[2:])
+	index := int(binary.BigEndian.Uint16(packet[10:]))
+	count := int(binary.BigEndian.Uint16(packet[12:]))
+	if count == 0 || count > DATAGRAM_MAX_CHUNKS || index >= count {
+		return nil, false
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gc(now)
+
+	p := r.partials[id]
+	if p == nil {
+		p = &datagramPartial{
+			chunks: make([][]byte, count),
+			size:   count * datagramSliceHeaderSize,
+			first:  now,
+		}
+		p.elem = r.order.PushBack(id)
+		r.partials[id] = p
+		r.buffered += p.size
+	}
+	if len(p.chunks) != count || p.chunks[index] != nil {
+		return nil, false // 与之前的切片矛盾，或者重复的切片
+	}
+
+	data := append([]byte(nil), packet[DATAGRAM_CHUNK_HEADER_SIZE:]...)
+	p.chunks[index] = data
+	p.received++
+	p.size += len(data)
+	r.buffered += len(data)
+	if p.received < count {
+		r.evict()
+		return nil, false
+	}
+
+	r.remove(id, p)
+	record = make([]byte, 0, p.size-count*datagramSliceHeaderSize)
+	for _, c := range p.chunks {
+		record = append(record, c...)
+	}
+	return record, true
+}
+
+// 还没收齐的日志条数
+func (r *DatagramReassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.partials)
+}
+
+// 以下调用时都持有 r.mu
+
+func (r *DatagramReassembler) remove(id uint64, p *datagramPartial) {
+	delete(r.partials, id)
+	r.order.Remove(p.elem)
+	r.buffered -= p.size
+}
+
+// 超过限制时丢弃最早的
+func (r *DatagramReassembler) evict() {
+	for len(r.partials) > r.maxPending || r.buffered > r.maxBuffered {
+		id := r.order.Front().Value.(uint64)
+		r.remove(id, r.partials[id])
+	}
+}
+
+func (r *DatagramReassembler) gc(now time.Time) {
+	if now.Sub(r.lastGC) < r.timeout {
+		return
+	}
+	r.lastGC = now
+	// order 按 first 排序，从前面删到没超时的为止
+	for e := r.order.Front(); e != nil; e = r.order.Front() {
+		id := e.Value.(uint64)
+		p := r.partials[id]
+		if now.Sub(p.first) < r.timeout {
+			break
+		}
+		r.remove(id, p)
+	}
+}
@@ -0,0 +1,92 @@
+package log4go
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+// 使用 v2 帧格式(参看 logframe 包)，帧头带上主机名、pid、app、logger名、级别、时间等，
+// app 为空时用程序名。要在写日志之前调用。
+//
+// v2 帧由 Formatter 的包装在IO线程中生成；直接调用 Write/WriteBatch 写入的数据，
+// 如果不是完整的 v2 帧，会加上只有主机名、pid、app 的帧头。
+func (h *SocketHandler) SetFrameV2(app string) {
+	if app == "" {
+		app = filepath.Base(os.Args[0])
+	}
+	hostname, _ := os.Hostname()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.frameV2 = true
+	h.frameHeader = logframe.Header{
+		Level:    LevelInfo,
+		Hostname: hostname,
+		App:      app,
+		Pid:      uint32(os.Getpid()),
+	}
+	if h.ack {
+		h.frameHeader.Flags |= logframe.FlagSeq
+		h.frameHeader.Session = h.session
+	}
+}
+
+// 每个 Formatter 对应一个包装，缓存起来不用每条日志分配
+func (h *SocketHandler) frameFormatter(inner Formatter) Formatter {
+	if inner == nil {
+		inner = globalTxtLineFormatter
+	}
+	if f, ok := h.frameFmts.Load(inner); ok {
+		return f.(Formatter)
+	}
+	f, _ := h.frameFmts.LoadOrStore(inner, &frameFormatter{h: h, inner: inner})
+	return f.(Formatter)
+}
+
+// 不是 v2 帧的数据加上默认的帧头
+func (h *SocketHandler) frameRecord(r []byte) []byte {
+	if logframe.IsV2Frame(r) {
+		return r
+	}
+	hdr := h.frameHeader
+	return logframe.AppendV2(nil, &hdr, r)
+}
+
+// v2 帧中 content type 的位置
+const v2ContentTypeOffset = logframe.V2PrefixSize + 1
+
+// 把日志格式化成一个完整的 v2 帧
+type frameFormatter struct {
+	h     *SocketHandler
+	inner Formatter
+}
+
+func (f *frameFormatter) Format(buff *bytes.Buffer,
+	l *LogInstance) (*bytes.Buffer, error) {
+
+	hdr := f.h.frameHeader
+	hdr.Level = uint8(l.LevelNo)
+	hdr.Timestamp = l.Timestamp
+	hdr.Logger = l.logger
+	if _, ok := f.inner.(*JSONFormatter); ok {
+		hdr.ContentType = logframe.ContentJSON
+	}
+
+	var scratch [128]byte
+	start := buff.Len()
+	buff.Write(logframe.AppendV2Header(scratch[:0], &hdr, 0))
+	bodyStart := buff.Len()
+
+	if _, err := f.inner.Format(buff, l); err != nil {
+		// 不能让IO线程在帧外面再写一份，这里直接退回文本格式
+		buff.Truncate(bodyStart)
+		globalTxtLineFormatter.Format(buff, l)
+		buff.Bytes()[start+v2ContentTypeOffset] = logframe.ContentText
+	}
+
+	logframe.SetV2BodyLen(buff.Bytes(), start, buff.Len()-bodyStart)
+	return buff, nil
+}
@@ -0,0 +1,446 @@
+package log4go
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 多个地址之间的分配方式
+const (
+	SocketBalanceRoundRobin = iota // 轮流
+	SocketBalanceHash              // 按字段的一致性哈希，同一个值总是发到同一个地址
+)
+
+const (
+	DEFAULT_SOCKET_PROBE_INTERVAL = 5 * time.Second
+
+	// 一致性哈希环上每个地址的虚拟节点数
+	SOCKET_HASH_REPLICAS = 100
+)
+
+//MultiSocketHandler writes log to several collectors, each address is a SocketHandler.
+//
+//默认轮流发到各个地址；SetHashField 以后按日志的字段(如 tenant)一致性哈希，
+//字段相同的日志总是发到同一个地址，没有该字段的日志轮流发。
+//
+//某个地址写失败时标记为不可用，这一批日志改发到下一个可用的地址，之后的日志不再分给它；
+//它在后台重连(最长间隔为 probeInterval)，每隔 probeInterval 检查一次，连上了就恢复分配。
+//一致性哈希时，不可用地址上的字段值顺延到环上的下一个地址，其它字段值不受影响；
+//写失败的那一批也按字段值重新选地址，同一个字段值的日志不会分散到两个地址。
+//
+//每个地址的帧格式与 SocketHandler 相同，可以用 Endpoints() 分别设置(如 SetFrameV2)，
+//但不要设置 SetSpool：断线时存盘就不会改发到别的地址了。
+type MultiSocketHandler struct {
+	endpoints   []*socketEndpoint
+	writeThread iHandleIOWriteThread
+
+	policy        int
+	field         string
+	ring          []hashPoint // 按 hash 排序
+	next          uint32
+	probeInterval time.Duration
+}
+
+type hashPoint struct {
+	hash uint64
+	ep   int
+}
+
+// 一个地址，作为 Handler 交给IO线程
+type socketEndpoint struct {
+	m *MultiSocketHandler
+	h *SocketHandler
+
+	down    int32 // 不为0时不分配日志
+	probeAt int64 // 下次检查是否恢复的时间，UnixNano
+
+	// 一致性哈希时，IO线程格式化的每条日志的字段值，按顺序与 WriteBatch 的 records 对应。
+	// 只在IO线程中使用
+	keys    []recordKey
+	keyFmts sync.Map // Formatter => *hashKeyFormatter
+}
+
+type recordKey struct {
+	size int // 日志的长度，用于检查是否与 records 对得上，-1 表示不知道
+	key  string
+	ok   bool // 日志有这个字段
+}
+
+func NewMultiSocketHandler(protocol string,
+	addrs []string) (*MultiSocketHandler, error) {
+
+	return newMultiSocketHandler(addrs, func(addr string) (*SocketHandler, error) {
+		return NewSocketHandler(protocol, addr)
+	})
+}
+
+// 每个地址都用TLS连接，参看 NewTLSSocketHandler
+func NewMultiTLSSocketHandler(protocol string, addrs []string,
+	config *tls.Config) (*MultiSocketHandler, error) {
+
+	return newMultiSocketHandler(addrs, func(addr string) (*SocketHandler, error) {
+		return NewTLSSocketHandler(protocol, addr, config)
+	})
+}
+
+func newMultiSocketHandler(addrs []string,
+	newHandler func(addr string) (*SocketHandler, error)) (*MultiSocketHandler, error) {
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("multi socket handler needs at least one address")
+	}
+
+	m := new(MultiSocketHandler)
+	m.policy = SocketBalanceRoundRobin
+	for _, addr := range addrs {
+		h, err := newHandler(addr)
+		if err != nil {
+			return nil, err
+		}
+		m.endpoints = append(m.endpoints, &socketEndpoint{m: m, h: h})
+	}
+	m.SetProbeInterval(DEFAULT_SOCKET_PROBE_INTERVAL)
+
+	for i, ep := range m.endpoints {
+		for j := 0; j < SOCKET_HASH_REPLICAS; j++ {
+			m.ring = append(m.ring, hashPoint{
+				hash: hashString(ep.h.addr + "#" + strconv.Itoa(j)),
+				ep:   i,
+			})
+		}
+	}
+	sort.Slice(m.ring, func(i, j int) bool { return m.ring[i].hash < m.ring[j].hash })
+	return m, nil
+}
+
+// fnv 对只差一两个字节的短字符串(如 tenant id)高位区分度不够，
+// 会落在环上的同一段，再用 murmur3 的 fmix64 打散
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// 按字段 field 的值一致性哈希，要在写日志之前调用。
+// 值最好是 string；其它类型每条日志都要 fmt.Sprint 一次，有额外的开销
+func (m *MultiSocketHandler) SetHashField(field string) {
+	m.field = field
+	m.policy = SocketBalanceHash
+}
+
+// 不可用的地址每隔 d 检查一次是否恢复，要在写日志之前调用。
+// 每个地址的重连等待时间最长改为 d(最短的不变)，之前用 Endpoints() 设置的最长等待时间会被覆盖
+func (m *MultiSocketHandler) SetProbeInterval(d time.Duration) {
+	m.probeInterval = d
+	for _, ep := range m.endpoints {
+		ep.h.mu.Lock()
+		min := ep.h.reconnectMin
+		ep.h.mu.Unlock()
+		if min > d {
+			min = d
+		}
+		ep.h.SetReconnectBackoff(min, d)
+	}
+}
+
+func (m *MultiSocketHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	m.writeThread = th
+}
+
+// 每个地址的 SocketHandler，顺序与创建时的 addrs 相同
+func (m *MultiSocketHandler) Endpoints() []*SocketHandler {
+	hs := make([]*SocketHandler, len(m.endpoints))
+	for i, ep := range m.endpoints {
+		hs[i] = ep.h
+	}
+	return hs
+}
+
+// 当前可用的地址
+func (m *MultiSocketHandler) Healthy() []string {
+	var addrs []string
+	for _, ep := range m.endpoints {
+		if ep.healthy() {
+			addrs = append(addrs, ep.h.addr)
+		}
+	}
+	return addrs
+}
+
+func (m *MultiSocketHandler) AsyncWrite(fmt Formatter, log *LogInstance) {
+	m.pick(log).AsyncWrite(fmt, log)
+}
+
+// p 当作一条日志，轮流发
+func (m *MultiSocketHandler) Write(p []byte) (n int, err error) {
+	if _, err = m.roundRobin().write([][]byte{p}, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *MultiSocketHandler) Close() error {
+	if m.writeThread != nil {
+		m.writeThread.Close()
+	}
+	for _, ep := range m.endpoints {
+		ep.h.Close()
+	}
+	return nil
+}
+
+// 选一个地址，全都不可用时也返回一个，写的时候出错
+func (m *MultiSocketHandler) pick(log *LogInstance) *socketEndpoint {
+	if m.policy == SocketBalanceHash {
+		if v, ok := log.KV[m.field]; ok {
+			return m.hash(v)
+		}
+	}
+	return m.roundRobin()
+}
+
+func (m *MultiSocketHandler) roundRobin() *socketEndpoint {
+	n := uint32(len(m.endpoints))
+	start := atomic.AddUint32(&m.next, 1) - 1
+	for i := uint32(0); i < n; i++ {
+		if ep := m.endpoints[(start+i)%n]; ep.healthy() {
+			return ep
+		}
+	}
+	return m.endpoints[start%n]
+}
+
+func (m *MultiSocketHandler) hash(v interface{}) *socketEndpoint {
+	return m.hashKey(hashFieldString(v))
+}
+
+func hashFieldString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v) // 参看 SetHashField
+}
+
+// 从值在环上的位置顺时针找第一个可用的地址
+func (m *MultiSocketHandler) hashKey(key string) *socketEndpoint {
+	hv := hashString(key)
+	start := sort.Search(len(m.ring), func(i int) bool { return m.ring[i].hash >= hv })
+	for i := 0; i < len(m.ring); i++ {
+		if ep := m.endpoints[m.ring[(start+i)%len(m.ring)].ep]; ep.healthy() {
+			return ep
+		}
+	}
+	return m.endpoints[m.ring[start%len(m.ring)].ep]
+}
+
+// 写失败的日志改发到 ep 之后第一个可用的地址。
+// keys 不为nil时(一致性哈希)，每条日志按字段值重新选地址
+func (m *MultiSocketHandler) failover(from *socketEndpoint,
+	records [][]byte, keys []recordKey, cause error) (n int, err error) {
+
+	if keys != nil {
+		return m.failoverHash(records, keys, cause)
+	}
+
+	idx := 0
+	for i, ep := range m.endpoints {
+		if ep == from {
+			idx = i
+		}
+	}
+
+	err = cause
+	for i := 1; i < len(m.endpoints) && len(records) > 0; i++ {
+		ep := m.endpoints[(idx+i)%len(m.endpoints)]
+		if !ep.healthy() {
+			continue
+		}
+		var k int
+		k, err = ep.h.WriteBatch(records)
+		n += k
+		records = records[k:]
+		if err != nil {
+			ep.markDown()
+		}
+	}
+	return
+}
+
+func (m *MultiSocketHandler) pickKey(k recordKey) *socketEndpoint {
+	if k.ok {
+		return m.hashKey(k.key)
+	}
+	return m.roundRobin()
+}
+
+func (m *MultiSocketHandler) failoverHash(records [][]byte,
+	keys []recordKey, cause error) (n int, err error) {
+
+	err = cause
+	for len(records) > 0 {
+		ep := m.pickKey(keys[0])
+		if !ep.healthy() {
+			return // 全都不可用
+		}
+		// 连续发往同一个地址的一起写
+		j := 1
+		for j < len(records) && keys[j].ok && keys[0].ok && m.hashKey(keys[j].key) == ep {
+			j++
+		}
+
+		var k int
+		k, err = ep.h.WriteBatch(records[:j])
+		n += k
+		records, keys = records[k:], keys[k:]
+		if err != nil {
+			ep.markDown()
+		}
+	}
+	return n, nil
+}
+
+//----------- 每个地址 ------------------------
+
+func (ep *socketEndpoint) AsyncWrite(fmt Formatter, log *LogInstance) {
+	if ep.h.frameV2 {
+		fmt = ep.h.frameFormatter(fmt)
+	}
+	if ep.m.policy == SocketBalanceHash {
+		fmt = ep.hashKeyFormatter(fmt)
+	}
+	if ep.m.writeThread != nil {
+		ep.m.writeThread.AsyncWrite(ep, fmt, log)
+	} else {
+		globalWriteThread.AsyncWrite(ep, fmt, log)
+	}
+}
+
+func (ep *socketEndpoint) SetWriteIOThread(th iHandleIOWriteThread) {
+	ep.m.SetWriteIOThread(th)
+}
+
+func (ep *socketEndpoint) Write(p []byte) (n int, err error) {
+	if _, err = ep.WriteBatch([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// IO线程调用
+func (ep *socketEndpoint) WriteBatch(records [][]byte) (n int, err error) {
+	return ep.write(records, ep.takeKeys(records))
+}
+
+// 写失败时标记为不可用，没写出去的改发到别的地址
+func (ep *socketEndpoint) write(records [][]byte, keys []recordKey) (n int, err error) {
+	if n, err = ep.h.WriteBatch(records); err == nil {
+		return
+	}
+	ep.markDown()
+
+	if keys != nil {
+		keys = keys[n:]
+	}
+	k, err := ep.m.failover(ep, records[n:], keys, err)
+	return n + k, err
+}
+
+// 取出与 records 对应的字段值。对不上时(如格式化时panic少了一条)清空重新开始，
+// 这一批按地址顺序改发
+func (ep *socketEndpoint) takeKeys(records [][]byte) []recordKey {
+	if ep.m.policy != SocketBalanceHash {
+		return nil
+	}
+
+	n := len(records)
+	ok := len(ep.keys) >= n
+	for i := 0; ok && i < n; i++ {
+		ok = ep.keys[i].size < 0 || ep.keys[i].size == len(records[i])
+	}
+	if !ok {
+		ep.keys = ep.keys[:0]
+		return nil
+	}
+
+	keys := append([]recordKey(nil), ep.keys[:n]...)
+	m := copy(ep.keys, ep.keys[n:])
+	for i := m; i < len(ep.keys); i++ {
+		ep.keys[i] = recordKey{}
+	}
+	ep.keys = ep.keys[:m]
+	return keys
+}
+
+func (ep *socketEndpoint) hashKeyFormatter(inner Formatter) Formatter {
+	if f, ok := ep.keyFmts.Load(inner); ok {
+		return f.(*hashKeyFormatter)
+	}
+	f, _ := ep.keyFmts.LoadOrStore(inner, &hashKeyFormatter{inner: inner, ep: ep})
+	return f.(*hashKeyFormatter)
+}
+
+// 在IO线程中格式化时记下日志的字段值
+type hashKeyFormatter struct {
+	inner Formatter
+	ep    *socketEndpoint
+}
+
+func (f *hashKeyFormatter) Format(buff *bytes.Buffer, log *LogInstance) (*bytes.Buffer, error) {
+	start := buff.Len()
+	b, err := f.inner.Format(buff, log)
+
+	k := recordKey{size: buff.Len() - start}
+	if err != nil {
+		k.size = -1 // IO线程会改用 TxtLineFormatter
+	}
+	if v, ok := log.KV[f.ep.m.field]; ok {
+		k.key, k.ok = hashFieldString(v), true
+	}
+	f.ep.keys = append(f.ep.keys, k)
+	return b, err
+}
+
+// 由 MultiSocketHandler 关闭
+func (ep *socketEndpoint) Close() error {
+	return nil
+}
+
+func (ep *socketEndpoint) markDown() {
+	if atomic.CompareAndSwapInt32(&ep.down, 0, 1) {
+		atomic.StoreInt64(&ep.probeAt,
+			time.Now().Add(ep.m.probeInterval).UnixNano())
+	}
+}
+
+// 不可用时，每隔 probeInterval 看一次后台重连是否成功
+func (ep *socketEndpoint) healthy() bool {
+	if atomic.LoadInt32(&ep.down) == 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	at := atomic.LoadInt64(&ep.probeAt)
+	if now < at || !atomic.CompareAndSwapInt64(&ep.probeAt, at,
+		now+int64(ep.m.probeInterval)) {
+		return false
+	}
+
+	if !ep.h.connected() {
+		return false
+	}
+	atomic.StoreInt32(&ep.down, 0)
+	return true
+}
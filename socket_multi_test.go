@@ -0,0 +1,249 @@
+package log4go_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+// 收集端：记下每个地址收到的日志
+type multiCollector struct {
+	lns []net.Listener
+
+	mu      sync.Mutex
+	records map[string][]string // addr => records
+}
+
+func newMultiCollector(t *testing.T, n int) *multiCollector {
+	mc := &multiCollector{records: make(map[string][]string)}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mc.serve(ln)
+	}
+	return mc
+}
+
+func (mc *multiCollector) serve(ln net.Listener) {
+	mc.lns = append(mc.lns, ln)
+	addr := ln.Addr().String()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					s, err := readFrame(c)
+					if err != nil {
+						return
+					}
+					mc.mu.Lock()
+					mc.records[addr] = append(mc.records[addr], strings.TrimSpace(s))
+					mc.mu.Unlock()
+				}
+			}()
+		}
+	}()
+}
+
+func (mc *multiCollector) addrs() []string {
+	var addrs []string
+	for _, ln := range mc.lns {
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs
+}
+
+func (mc *multiCollector) close() {
+	for _, ln := range mc.lns {
+		ln.Close()
+	}
+}
+
+func (mc *multiCollector) wait(t *testing.T, n int) map[string][]string {
+	for i := 0; i < 500; i++ {
+		mc.mu.Lock()
+		sum := 0
+		for _, rs := range mc.records {
+			sum += len(rs)
+		}
+		mc.mu.Unlock()
+		if sum >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	records := make(map[string][]string)
+	sum := 0
+	for addr, rs := range mc.records {
+		records[addr] = append([]string(nil), rs...)
+		sum += len(rs)
+	}
+	if sum != n {
+		t.Fatalf("got %d records, want %d: %v", sum, n, records)
+	}
+	return records
+}
+
+func TestMultiSocketHandlerRoundRobin(t *testing.T) {
+	mc := newMultiCollector(t, 3)
+	defer mc.close()
+
+	h, err := log.NewMultiSocketHandler("tcp", mc.addrs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testMultiSocketRR", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+	for i := 0; i < 30; i++ {
+		logger.Info("record %d", i)
+	}
+
+	records := mc.wait(t, 30)
+	for _, addr := range mc.addrs() {
+		if len(records[addr]) != 10 {
+			t.Fatalf("%s: %d records", addr, len(records[addr]))
+		}
+	}
+	logger.Close()
+}
+
+func TestMultiSocketHandlerHash(t *testing.T) {
+	mc := newMultiCollector(t, 3)
+	defer mc.close()
+
+	h, err := log.NewMultiSocketHandler("tcp", mc.addrs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetHashField("tenant")
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testMultiSocketHash", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+
+	tenants := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i := 0; i < 10; i++ {
+		for _, tenant := range tenants {
+			logger.WithField("tenant", tenant).Info("tenant=%s %d", tenant, i)
+		}
+	}
+
+	// 同一个 tenant 的日志都在同一个地址
+	records := mc.wait(t, 10*len(tenants))
+	where := make(map[string]string)
+	for addr, rs := range records {
+		for _, r := range rs {
+			i := strings.Index(r, "tenant=")
+			tenant := r[i+len("tenant=") : i+len("tenant=")+1]
+			if prev, ok := where[tenant]; ok && prev != addr {
+				t.Fatalf("tenant %s on %s and %s", tenant, prev, addr)
+			}
+			where[tenant] = addr
+		}
+	}
+	if len(records) < 2 {
+		t.Fatalf("all tenants on one address: %v", where)
+	}
+	logger.Close()
+}
+
+func TestMultiSocketHandlerFailover(t *testing.T) {
+	mc := newMultiCollector(t, 2)
+	defer mc.close()
+	addrs := mc.addrs()
+
+	// 第二个地址没有人监听
+	down := unusedAddr(t)
+	h, err := log.NewMultiSocketHandler("tcp", []string{addrs[0], down, addrs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetProbeInterval(50 * time.Millisecond)
+	defer h.Close()
+
+	for i := 0; i < 30; i++ {
+		if _, err := h.Write([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := mc.wait(t, 30)
+	if len(records[addrs[0]]) < 10 || len(records[addrs[1]]) < 10 {
+		t.Fatalf("unexpected distribution: %v", records)
+	}
+	if healthy := h.Healthy(); len(healthy) != 2 {
+		t.Fatalf("healthy = %v", healthy)
+	}
+
+	// 恢复后重新分配
+	ln, err := net.Listen("tcp", down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.serve(ln)
+	for i := 0; i < 100 && len(h.Healthy()) != 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if healthy := h.Healthy(); len(healthy) != 3 {
+		t.Fatalf("healthy = %v", healthy)
+	}
+	for i := 30; i < 60; i++ {
+		h.Write([]byte(fmt.Sprintf("record %d", i)))
+	}
+	records = mc.wait(t, 60)
+	if len(records[down]) != 10 {
+		t.Fatalf("%s: %d records", down, len(records[down]))
+	}
+}
+
+func TestMultiSocketHandlerHashFailover(t *testing.T) {
+	mc := newMultiCollector(t, 2)
+	defer mc.close()
+	addrs := mc.addrs()
+
+	down := unusedAddr(t)
+	h, err := log.NewMultiSocketHandler("tcp", []string{addrs[0], down, addrs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetHashField("tenant")
+	h.SetProbeInterval(time.Minute)
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testMultiSocketHashFailover", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+
+	tenants := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i := 0; i < 10; i++ {
+		for _, tenant := range tenants {
+			logger.WithField("tenant", tenant).Info("tenant=%s %d", tenant, i)
+		}
+	}
+
+	// 写失败改发的日志也按 tenant 选地址，同一个 tenant 不会分到两个地址
+	records := mc.wait(t, 10*len(tenants))
+	where := make(map[string]string)
+	for addr, rs := range records {
+		for _, r := range rs {
+			i := strings.Index(r, "tenant=")
+			tenant := r[i+len("tenant=") : i+len("tenant=")+1]
+			if prev, ok := where[tenant]; ok && prev != addr {
+				t.Fatalf("tenant %s on %s and %s", tenant, prev, addr)
+			}
+			where[tenant] = addr
+		}
+	}
+	if len(where) != len(tenants) {
+		t.Fatalf("missing tenants: %v", where)
+	}
+	logger.Close()
+}
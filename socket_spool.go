@@ -0,0 +1,229 @@
+package log4go
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+// 每个分段文件的大小上限
+const SOCKET_SPOOL_SEGMENT_BYTES = 1 << 20
+
+var errSpoolFull = errors.New("socket spool is full")
+
+// 断线期间，SocketHandler 把要发送的数据(已经分好帧)按顺序存到磁盘上，
+// 重连后从最旧的分段开始重发。
+//
+// 目录下的文件名为 spool-<序号>.seg，序号递增；
+// 进程重启后，上次没发完的分段会在下一次连上时一起重发。
+// 进程崩溃时最后一帧可能只写了一半，打开时检查每个分段，截断到最后一个完整的帧。
+// 不是并发安全的，由 SocketHandler.mu 保护。
+type diskSpool struct {
+	dir      string
+	maxBytes int64
+	segBytes int64
+
+	segs    []spoolSegment // 从旧到新
+	size    int64
+	nextSeq uint64
+	w       *os.File // 最新分段的写句柄，为nil时下次写新建分段
+}
+
+type spoolSegment struct {
+	seq  uint64
+	size int64
+}
+
+func openDiskSpool(dir string, maxBytes int64) (*diskSpool, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("spool max bytes must >0")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &diskSpool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		segBytes: SOCKET_SPOOL_SEGMENT_BYTES,
+	}
+	if s.segBytes > maxBytes {
+		s.segBytes = maxBytes
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "spool-*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		base := filepath.Base(name)
+		seq, err := strconv.ParseUint(
+			strings.TrimSuffix(strings.TrimPrefix(base, "spool-"), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		size, err := checkSpoolSegment(name)
+		if err != nil {
+			reportInternalError(err)
+			continue
+		}
+		if size == 0 {
+			os.Remove(name)
+			continue
+		}
+		s.segs = append(s.segs, spoolSegment{seq, size})
+		s.size += size
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+	if n := len(s.segs); n > 0 {
+		s.nextSeq = s.segs[n-1].seq + 1
+	}
+	return s, nil
+}
+
+// 分段中完整的帧的长度，后面损坏的数据截断
+func checkSpoolSegment(name string) (int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	n := spoolValidLen(data)
+	if n == len(data) {
+		return int64(n), nil
+	}
+
+	reportInternalError(fmt.Errorf("socket spool %s: %d corrupted bytes dropped",
+		name, len(data)-n))
+	if n > 0 {
+		if err = os.Truncate(name, int64(n)); err != nil {
+			return 0, err
+		}
+	}
+	return int64(n), nil
+}
+
+// spool 中一帧(v1 或 v2)的长度，不完整或格式不对时返回0
+func spoolFrameLen(data []byte) int {
+	var n int
+	switch {
+	case len(data) >= logframe.V2PrefixSize && data[0] == logframe.Magic:
+		if data[1] != logframe.Version2 {
+			return 0
+		}
+		n = logframe.V2PrefixSize + int(binary.BigEndian.Uint16(data[4:])) +
+			int(binary.BigEndian.Uint32(data[6:]))
+	case len(data) >= logframe.V1HeaderSize:
+		size := int(binary.BigEndian.Uint32(data))
+		if size == 0 {
+			return 0
+		}
+		n = logframe.V1HeaderSize + size
+	default:
+		return 0
+	}
+	if n > len(data) {
+		return 0
+	}
+	return n
+}
+
+// data 开头完整的帧的总长度
+func spoolValidLen(data []byte) int {
+	n := 0
+	for n < len(data) {
+		k := spoolFrameLen(data[n:])
+		if k == 0 {
+			break
+		}
+		n += k
+	}
+	return n
+}
+
+func (s *diskSpool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("spool-%020d.seg", seq))
+}
+
+// 满了返回 errSpoolFull，不会覆盖旧数据
+func (s *diskSpool) append(p []byte) error {
+	if s.size+int64(len(p)) > s.maxBytes {
+		return errSpoolFull
+	}
+
+	last := len(s.segs) - 1
+	if s.w == nil || s.segs[last].size+int64(len(p)) > s.segBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = len(s.segs) - 1
+	}
+
+	n, err := s.w.Write(p)
+	s.segs[last].size += int64(n)
+	s.size += int64(n)
+	return err
+}
+
+func (s *diskSpool) rotate() error {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+
+	f, err := os.OpenFile(s.path(s.nextSeq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.w = f
+	s.segs = append(s.segs, spoolSegment{seq: s.nextSeq})
+	s.nextSeq++
+	return nil
+}
+
+func (s *diskSpool) empty() bool {
+	return len(s.segs) == 0
+}
+
+// 读出最旧的分段，发送成功后调用 pop 删除
+func (s *diskSpool) front() ([]byte, error) {
+	if s.w != nil && len(s.segs) == 1 {
+		// 正在写的分段，封口后再读，之后的数据写到新分段
+		s.w.Close()
+		s.w = nil
+	}
+	name := s.path(s.segs[0].seq)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// 写的时候出错(如磁盘满)可能只写了半帧，不能发给对方
+	if n := spoolValidLen(data); n < len(data) {
+		reportInternalError(fmt.Errorf("socket spool %s: %d corrupted bytes dropped",
+			name, len(data)-n))
+		data = data[:n]
+	}
+	return data, nil
+}
+
+func (s *diskSpool) pop() {
+	seg := s.segs[0]
+	if err := os.Remove(s.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+		reportInternalError(err)
+	}
+	s.size -= seg.size
+	s.segs = s.segs[1:]
+}
+
+func (s *diskSpool) close() {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
@@ -1,18 +1,93 @@
 package log4go
 
 import (
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+// 重连的等待时间，从 min 开始翻倍到 max，实际等待 [d/2, d) 之间的随机值
+const (
+	DEFAULT_SOCKET_RECONNECT_MIN = 100 * time.Millisecond
+	DEFAULT_SOCKET_RECONNECT_MAX = 30 * time.Second
+	SOCKET_DIAL_TIMEOUT          = 5 * time.Second
+)
+
+const (
+	sockIdle         = iota // 还没有连接过
+	sockConnected           // 已连接
+	sockReconnecting        // 后台重连中
+	sockReplaying           // 已重连，正在重发 spool 中的数据
+	sockClosed
+)
+
+var (
+	errSocketDisconnected = errors.New("socket handler disconnected")
+	errSocketClosed       = errors.New("socket handler closed")
 )
 
 //SocketHandler writes log to a connectionl.
 //Network protocol is simple: log length + log | log length + log. log length is uint32, bigendian.
-//you must implement your own log server, maybe you can use logd instead simply.
+//Each frame carries exactly one log record.
+//you must implement your own log server, maybe you can use cmd/logd instead simply.
+//
+//protocol 为 udp/unixgram 时是报文模式，参看 socket_datagram.go。
+//SetFrameV2 以后用 v2 帧格式，带上记录的元数据，参看 socket_frame.go。
+//SetAck 以后对方要回确认，断线后没确认的帧会重发(至少一次)，参看 socket_ack.go。
+//
+//第一次写时同步连接；之后断线了在后台重连(指数退避+随机抖动)，不阻塞IO线程。
+//断线期间的日志：设置了 SetSpool 时按顺序存到磁盘，重连后先重发；否则直接返回错误。
 type SocketHandler struct {
-	c        net.Conn
-	protocol string
-	addr     string
+	protocol  string
+	addr      string
+	tlsConfig *tls.Config // 不为nil时用TLS连接
+
+	writeThread iHandleIOWriteThread
+
+	mu           sync.Mutex
+	c            net.Conn
+	state        int   // 用 setState 修改
+	isConnected  int32 // state == sockConnected，不用加锁就能读
+	spool        *diskSpool
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// 报文模式，参看 socket_datagram.go
+	datagram   bool
+	maxPayload int
+	msgID      uint64
+	chunk      []byte
+
+	// 流模式 writev 用
+	bufs net.Buffers
+	lens []byte
+
+	// v2 帧格式，参看 socket_frame.go
+	frameV2     bool
+	frameHeader logframe.Header
+	frameFmts   sync.Map // Formatter => *frameFormatter
+
+	// 确认模式，参看 socket_ack.go
+	ack        bool
+	ackWindow  int
+	ackTimeout time.Duration
+	ackCond    *sync.Cond // 用 h.mu
+	ackConn    net.Conn   // 正在读确认的连接
+	ackErr     error      // ackConn 读确认出错
+	session    uint64
+	nextSeq    uint64
+	unacked    []unackedFrame
 }
 
 func NewSocketHandler(protocol string, addr string) (*SocketHandler, error) {
@@ -20,33 +95,239 @@ func NewSocketHandler(protocol string, addr string) (*SocketHandler, error) {
 
 	s.protocol = protocol
 	s.addr = addr
+	s.reconnectMin = DEFAULT_SOCKET_RECONNECT_MIN
+	s.reconnectMax = DEFAULT_SOCKET_RECONNECT_MAX
+	s.quit = make(chan struct{})
+	s.datagram = isDatagramProtocol(protocol)
+	s.maxPayload = DEFAULT_DATAGRAM_MAX_PAYLOAD
+	s.msgID = newDatagramMsgID()
 
 	return s, nil
 }
 
+// 用TLS加密的SocketHandler，帧格式不变。protocol 只能是 tcp/tcp4/tcp6。
+// config 可以设置客户端证书(Certificates)、根证书(RootCAs)、服务端名字(ServerName)等，
+// ServerName 为空时用 addr 中的主机名校验服务端证书。
+func NewTLSSocketHandler(protocol string, addr string,
+	config *tls.Config) (*SocketHandler, error) {
+
+	switch protocol {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("tls does not support protocol %q", protocol)
+	}
+	if config == nil {
+		return nil, fmt.Errorf("tls config is nil")
+	}
+
+	s, err := NewSocketHandler(protocol, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig = config.Clone()
+	return s, nil
+}
+
+func (h *SocketHandler) AsyncWrite(fmt Formatter, log *LogInstance) {
+	if h.frameV2 {
+		fmt = h.frameFormatter(fmt)
+	}
+	if h.writeThread != nil {
+		h.writeThread.AsyncWrite(h, fmt, log)
+	} else {
+		globalWriteThread.AsyncWrite(h, fmt, log)
+	}
+}
+
+func (h *SocketHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.writeThread = th
+}
+
+// 调用时持有 h.mu
+func (h *SocketHandler) setState(state int) {
+	h.state = state
+	if state == sockConnected {
+		atomic.StoreInt32(&h.isConnected, 1)
+	} else {
+		atomic.StoreInt32(&h.isConnected, 0)
+	}
+}
+
+// 不加锁，IO线程写的时候(持有 h.mu)也不会阻塞
+func (h *SocketHandler) connected() bool {
+	return atomic.LoadInt32(&h.isConnected) != 0
+}
+
+// 重连等待时间从 min 开始翻倍，最多 max。min <=0 时用默认值，max 小于 min 时等于 min
+func (h *SocketHandler) SetReconnectBackoff(min, max time.Duration) {
+	if min <= 0 {
+		min = DEFAULT_SOCKET_RECONNECT_MIN
+	}
+	if max < min {
+		max = min
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reconnectMin = min
+	h.reconnectMax = max
+}
+
+// 断线期间的日志存到 dir 目录，最多 maxBytes 字节，满了以后的日志丢弃(Write返回错误)。
+// dir 中上次进程没发完的数据，连上后先于新的日志重发。
+// 报文模式不支持。
+func (h *SocketHandler) SetSpool(dir string, maxBytes int64) error {
+	if h.datagram {
+		return fmt.Errorf("spool does not support protocol %q", h.protocol)
+	}
+
+	spool, err := openDiskSpool(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.spool != nil {
+		h.spool.close()
+	}
+	h.spool = spool
+	return nil
+}
+
+// p 当作一条日志，一帧
 func (h *SocketHandler) Write(p []byte) (n int, err error) {
-	if err = h.connect(); err != nil {
-		return
+	if _, err = h.WriteBatch([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 每条日志一帧(报文模式每条一个报文)，流模式下一批日志只调用一次 writev
+func (h *SocketHandler) WriteBatch(records [][]byte) (n int, err error) {
+	if h.datagram {
+		return h.writeDatagrams(records)
 	}
 
-	buf := make([]byte, len(p)+4)
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	switch h.state {
+	case sockIdle:
+		if h.spool != nil && !h.spool.empty() {
+			// 上次进程没发完的数据要先发，这一批排在后面
+			h.startReconnect(true)
+			return h.spoolFrames(records, errSocketDisconnected)
+		}
+		if err = h.connect(); err != nil {
+			h.startReconnect(false)
+			return h.spoolFrames(records, err)
+		}
+		h.setState(sockConnected)
+	case sockConnected:
+	case sockClosed:
+		return 0, errSocketClosed
+	default:
+		// 重连/重发中，先存起来保证顺序
+		return h.spoolFrames(records, errSocketDisconnected)
+	}
 
-	copy(buf[4:], p)
+	if h.ack {
+		return h.writeAcked(records)
+	}
 
-	n, err = h.c.Write(buf)
+	if cap(h.lens) < 4*len(records) {
+		h.lens = make([]byte, 4*len(records))
+	}
+	bufs := h.bufs[:0]
+	for i, r := range records {
+		if h.frameV2 {
+			// v2 帧自带长度
+			bufs = append(bufs, h.frameRecord(r))
+			continue
+		}
+		size := h.lens[4*i : 4*i+4]
+		binary.BigEndian.PutUint32(size, uint32(len(r)))
+		bufs = append(bufs, size, r)
+	}
+	h.bufs = bufs
+
+	// WriteTo 会修改bufs，用副本
+	vec := bufs
+	_, err = vec.WriteTo(h.c)
+	for i := range bufs {
+		bufs[i] = nil
+	}
 	if err != nil {
-		h.c.Close()
-		h.c = nil
+		// 不知道对方收到了多少，全部存起来重发，对方可能收到重复的日志
+		h.connLost(h.c)
+		return h.spoolFrames(records, err)
+	}
+	return len(records), nil
+}
+
+// 断线时分好帧存到spool，没有spool时返回 cause
+func (h *SocketHandler) spoolFrames(records [][]byte, cause error) (n int, err error) {
+	if h.spool == nil {
+		return 0, cause
+	}
+
+	var frame []byte
+	for _, r := range records {
+		if h.ack {
+			h.nextSeq++
+			if err = h.spool.append(h.seqFrame(r, h.nextSeq)); err != nil {
+				return
+			}
+			n++
+			continue
+		}
+		if h.frameV2 {
+			if err = h.spool.append(h.frameRecord(r)); err != nil {
+				return
+			}
+			n++
+			continue
+		}
+		frame = append(frame[:0], 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(frame, uint32(len(r)))
+		frame = append(frame, r...)
+		if err = h.spool.append(frame); err != nil {
+			return
+		}
+		n++
 	}
 	return
 }
 
 func (h *SocketHandler) Close() error {
+	if h.writeThread != nil {
+		h.writeThread.Close()
+	}
+
+	h.mu.Lock()
+	if h.state == sockClosed {
+		h.mu.Unlock()
+		return nil
+	}
+	if h.ack {
+		h.drainUnacked()
+	}
+	h.setState(sockClosed)
+	if h.ackCond != nil {
+		h.ackCond.Broadcast()
+	}
 	if h.c != nil {
 		h.c.Close()
+		h.c = nil
+	}
+	if h.spool != nil {
+		h.spool.close()
 	}
+	h.mu.Unlock()
+
+	close(h.quit)
+	h.wg.Wait()
 	return nil
 }
 
@@ -55,11 +336,141 @@ func (h *SocketHandler) connect() error {
 		return nil
 	}
 
-	var err error
-	h.c, err = net.DialTimeout(h.protocol, h.addr, 5*time.Second)
+	c, err := h.dial()
 	if err != nil {
 		return err
 	}
 
+	h.c = c
+	if h.ack {
+		h.startAckReader(c)
+	}
 	return nil
 }
+
+func (h *SocketHandler) dial() (net.Conn, error) {
+	if h.tlsConfig != nil {
+		// 握手也算在超时内
+		dialer := &net.Dialer{Timeout: SOCKET_DIAL_TIMEOUT}
+		return tls.DialWithDialer(dialer, h.protocol, h.addr, h.tlsConfig)
+	}
+	return net.DialTimeout(h.protocol, h.addr, SOCKET_DIAL_TIMEOUT)
+}
+
+//----------- 后台重连 ------------------------
+
+// 连接 c 出错，关闭连接并在后台重连。调用时持有 h.mu。
+// c 已经不是当前连接时(已经处理过，或已经重连上了)什么也不做
+func (h *SocketHandler) connLost(c net.Conn) {
+	if h.c == nil || h.c != c {
+		return
+	}
+	h.c.Close()
+	h.c = nil
+	if h.ack {
+		h.saveUnacked()
+	}
+	h.startReconnect(false)
+}
+
+// 调用时持有 h.mu。now 为true时第一次不等待，马上连接
+func (h *SocketHandler) startReconnect(now bool) {
+	h.setState(sockReconnecting)
+	h.wg.Add(1)
+	go h.reconnect(now, h.reconnectMin, h.reconnectMax)
+}
+
+func (h *SocketHandler) reconnect(now bool, backoff, max time.Duration) {
+	defer h.wg.Done()
+
+	for {
+		wait := backoff / 2
+		if backoff > 1 {
+			wait += time.Duration(rand.Int63n(int64(backoff / 2)))
+		}
+		if now {
+			wait, now = 0, false
+		}
+
+		select {
+		case <-h.quit:
+			return
+		case <-time.After(wait):
+		}
+
+		if c, err := h.dial(); err == nil && h.replay(c) {
+			return
+		}
+
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// 把spool中的数据按顺序发到新连接，发完后切换为已连接状态。
+// 发送失败返回false，继续重连。
+func (h *SocketHandler) replay(c net.Conn) bool {
+	if h.ack && !h.resendUnacked(c) {
+		return false
+	}
+
+	for {
+		h.mu.Lock()
+		if h.state == sockClosed {
+			h.mu.Unlock()
+			c.Close()
+			return true
+		}
+		if h.spool == nil || h.spool.empty() {
+			if h.ack && h.ackErr != nil {
+				h.mu.Unlock()
+				return h.replayFailed(c)
+			}
+			h.c = c
+			h.setState(sockConnected)
+			h.mu.Unlock()
+			return true
+		}
+
+		// 重发期间新的日志继续写到spool
+		h.setState(sockReplaying)
+		data, err := h.spool.front()
+		h.mu.Unlock()
+
+		if err == nil {
+			if h.ack {
+				err = h.replayAcked(c, data)
+			} else {
+				_, err = c.Write(data)
+			}
+			if err != nil {
+				return h.replayFailed(c)
+			}
+		} else {
+			// 读不出来的分段只能丢掉
+			reportInternalError(err)
+		}
+
+		h.mu.Lock()
+		if h.spool != nil && !h.spool.empty() {
+			h.spool.pop()
+		}
+		h.mu.Unlock()
+	}
+}
+
+// 重发失败，关闭连接继续重连。调用时不持有 h.mu
+func (h *SocketHandler) replayFailed(c net.Conn) bool {
+	c.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state != sockClosed {
+		h.setState(sockReconnecting)
+	}
+	if h.ack && h.spool != nil {
+		// 窗口里只有spool当前分段的帧，分段还没删，下次重连后再发
+		h.clearUnacked()
+	}
+	return false
+}
@@ -0,0 +1,913 @@
+package log4go_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+	"github.com/kingsoft-wps/log4go/logframe"
+)
+
+// 按 长度+内容 读出一帧
+func readFrame(r io.Reader) (string, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// 取一个当前没人监听的地址
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestSocketHandlerSpool(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := unusedAddr(t)
+	h, _ := log.NewSocketHandler("tcp", addr)
+	h.SetReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)
+	if err := h.SetSpool(filepath.Join(dir, "spool"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// 直接调用 Write，每次一帧
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if _, err := h.Write([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("write blocked %v while disconnected", d)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 重连后写的日志排在spool之后
+	go func() {
+		for i := 100; i < 110; i++ {
+			h.Write([]byte(fmt.Sprintf("record %d", i)))
+		}
+	}()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 110; i++ {
+		s, err := readFrame(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("record %d", i); s != want {
+			t.Fatalf("got %q, want %q", s, want)
+		}
+	}
+	h.Close()
+
+	if names, _ := filepath.Glob(filepath.Join(dir, "spool", "*.seg")); len(names) != 0 {
+		t.Fatalf("spool not cleaned: %v", names)
+	}
+}
+
+// 上次进程留在spool中的数据，第一次连上时先发
+func TestSocketHandlerSpoolLeftover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := unusedAddr(t)
+	h, _ := log.NewSocketHandler("tcp", addr)
+	h.SetReconnectBackoff(time.Hour, time.Hour)
+	h.SetSpool(dir, 1<<20)
+	if _, err := h.Write([]byte("old record")); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	h, _ = log.NewSocketHandler("tcp", addr)
+	h.SetSpool(dir, 1<<20)
+	defer h.Close()
+	if _, err := h.Write([]byte("new record")); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"old record", "new record"} {
+		if s, err := readFrame(c); err != nil || s != want {
+			t.Fatalf("got %q %v, want %q", s, err, want)
+		}
+	}
+}
+
+// 上次进程崩溃时最后一帧只写了一半，打开时截掉，不能发给对方
+func TestSocketHandlerSpoolTorn(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := unusedAddr(t)
+	h, _ := log.NewSocketHandler("tcp", addr)
+	h.SetReconnectBackoff(time.Hour, time.Hour)
+	h.SetSpool(dir, 1<<20)
+	h.Write([]byte("old record"))
+	h.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(names) != 1 {
+		t.Fatalf("segments: %v", names)
+	}
+	f, _ := os.OpenFile(names[0], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 0, 100, 'x', 'y'}) // 长度100，只有2字节
+	f.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	h, _ = log.NewSocketHandler("tcp", addr)
+	h.SetSpool(dir, 1<<20)
+	defer h.Close()
+	h.Write([]byte("new record"))
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"old record", "new record"} {
+		if s, err := readFrame(c); err != nil || s != want {
+			t.Fatalf("got %q %v, want %q", s, err, want)
+		}
+	}
+}
+
+func TestSocketHandlerNoSpool(t *testing.T) {
+	h, _ := log.NewSocketHandler("tcp", unusedAddr(t))
+	h.SetReconnectBackoff(time.Hour, time.Hour)
+	defer h.Close()
+
+	if _, err := h.Write([]byte("first")); err == nil {
+		t.Fatal("expect dial error")
+	}
+
+	// 之后不再同步连接，直接返回错误
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := h.Write([]byte("x")); err == nil {
+			t.Fatal("expect error while disconnected")
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("write blocked %v while disconnected", d)
+	}
+}
+
+func TestSocketHandlerSpoolFull(t *testing.T) {
+	dir, err := os.MkdirTemp("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, _ := log.NewSocketHandler("tcp", unusedAddr(t))
+	h.SetReconnectBackoff(time.Hour, time.Hour)
+	h.SetSpool(dir, 100)
+	defer h.Close()
+
+	var err2 error
+	for i := 0; i < 10 && err2 == nil; i++ {
+		_, err2 = h.Write(make([]byte, 20))
+	}
+	if err2 == nil {
+		t.Fatal("expect spool full error")
+	}
+}
+
+// 生成证书，parent 为nil时自签名(CA)
+func newTestCert(t *testing.T, cn string, parent *tls.Certificate,
+	usage x509.ExtKeyUsage) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{cn},
+	}
+
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSSocketHandler(t *testing.T) {
+	ca := newTestCert(t, "log4go test ca", nil, x509.ExtKeyUsageAny)
+	serverCert := newTestCert(t, "logd.test", &ca, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, "client.test", &ca, x509.ExtKeyUsageClientAuth)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	frames := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					s, err := readFrame(c)
+					if err != nil {
+						return
+					}
+					frames <- s
+				}
+			}(c)
+		}
+	}()
+
+	// 服务端名字不对，握手失败
+	bad, _ := log.NewTLSSocketHandler("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+		ServerName:   "other.test",
+	})
+	bad.SetReconnectBackoff(time.Hour, time.Hour)
+	if _, err := bad.Write([]byte("x")); err == nil {
+		t.Fatal("expect certificate error")
+	}
+	bad.Close()
+
+	h, err := log.NewTLSSocketHandler("tcp", ln.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+		ServerName:   "logd.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testTLSSocket", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+	logger.Info("over tls")
+	logger.Close()
+
+	select {
+	case s := <-frames:
+		if s != "INFO - over tls\n" {
+			t.Fatalf("unexpected frame: %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame not received")
+	}
+
+	if _, err := log.NewTLSSocketHandler("udp", "127.0.0.1:1", &tls.Config{}); err == nil {
+		t.Fatal("expect error for udp")
+	}
+}
+
+func TestSocketHandlerDatagram(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	h, _ := log.NewSocketHandler("udp", pc.LocalAddr().String())
+	if err := h.SetMaxPayload(100); err != nil {
+		t.Fatal(err)
+	}
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testSocketDatagram", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+
+	big := strings.Repeat("0123456789", 100)
+	logger.Info("small 1")
+	logger.Info(big)
+	logger.Info("small 2")
+	logger.Close()
+
+	want := []string{"INFO - small 1\n", "INFO - " + big + "\n", "INFO - small 2\n"}
+	r := log.NewDatagramReassembler(time.Second)
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for packets := 0; len(want) > 0; packets++ {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 100 {
+			t.Fatalf("packet too large: %d", n)
+		}
+		record, ok := r.Add(buf[:n])
+		if !ok {
+			continue
+		}
+		if string(record) != want[0] {
+			t.Fatalf("packet %d: got %q, want %q", packets, record, want[0])
+		}
+		want = want[1:]
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("pending=%d", r.Pending())
+	}
+}
+
+func TestSocketHandlerDatagramNoSpool(t *testing.T) {
+	h, _ := log.NewSocketHandler("udp", "127.0.0.1:9")
+	defer h.Close()
+	if err := h.SetSpool(os.TempDir(), 1<<20); err == nil {
+		t.Fatal("expect error for datagram spool")
+	}
+}
+
+func TestDatagramReassembler(t *testing.T) {
+	chunk := func(id uint64, index, count int, data string) []byte {
+		p := make([]byte, log.DATAGRAM_CHUNK_HEADER_SIZE, log.DATAGRAM_CHUNK_HEADER_SIZE+len(data))
+		p[0], p[1] = 0x1e, 0x0f
+		binary.BigEndian.PutUint64(p[2:], id)
+		binary.BigEndian.PutUint16(p[10:], uint16(index))
+		binary.BigEndian.PutUint16(p[12:], uint16(count))
+		return append(p, data...)
+	}
+
+	r := log.NewDatagramReassembler(50 * time.Millisecond)
+
+	// 乱序、重复
+	if _, ok := r.Add(chunk(1, 2, 3, "c")); ok {
+		t.Fatal("incomplete")
+	}
+	r.Add(chunk(1, 0, 3, "a"))
+	r.Add(chunk(1, 0, 3, "a"))
+	if rec, ok := r.Add(chunk(1, 1, 3, "b")); !ok || string(rec) != "abc" {
+		t.Fatalf("got %q %v", rec, ok)
+	}
+
+	// 超时丢弃
+	r.Add(chunk(2, 0, 2, "x"))
+	time.Sleep(60 * time.Millisecond)
+	r.Add(chunk(3, 0, 2, "y"))
+	if n := r.Pending(); n != 1 {
+		t.Fatalf("pending=%d", n)
+	}
+	if _, ok := r.Add(chunk(2, 1, 2, "x")); ok {
+		t.Fatal("expired record reassembled")
+	}
+}
+
+// 伪造的切片头不能让接收方无限分配内存
+func TestDatagramReassemblerHostile(t *testing.T) {
+	chunk := func(id uint64, index, count int, data string) []byte {
+		p := make([]byte, log.DATAGRAM_CHUNK_HEADER_SIZE, log.DATAGRAM_CHUNK_HEADER_SIZE+len(data))
+		p[0], p[1] = 0x1e, 0x0f
+		binary.BigEndian.PutUint64(p[2:], id)
+		binary.BigEndian.PutUint16(p[10:], uint16(index))
+		binary.BigEndian.PutUint16(p[12:], uint16(count))
+		return append(p, data...)
+	}
+
+	r := log.NewDatagramReassembler(time.Hour)
+	r.SetLimits(10, 1<<20)
+
+	// 总片数太多，直接拒绝
+	if _, ok := r.Add(chunk(1, 0, 0xffff, "x")); ok || r.Pending() != 0 {
+		t.Fatalf("pending=%d", r.Pending())
+	}
+
+	// 大量不同的消息ID，只保留最新的10条
+	for id := uint64(100); id < 10000; id++ {
+		r.Add(chunk(id, 0, 2, "x"))
+	}
+	if n := r.Pending(); n != 10 {
+		t.Fatalf("pending=%d", n)
+	}
+	if _, ok := r.Add(chunk(100, 1, 2, "y")); ok {
+		t.Fatal("evicted record reassembled")
+	}
+	if rec, ok := r.Add(chunk(9999, 1, 2, "y")); !ok || string(rec) != "xy" {
+		t.Fatalf("got %q %v", rec, ok)
+	}
+
+	// 字节数超过限制，丢弃最早的
+	r = log.NewDatagramReassembler(time.Hour)
+	r.SetLimits(1000, 10000)
+	big := strings.Repeat("x", 4000)
+	for id := uint64(1); id <= 3; id++ {
+		r.Add(chunk(id, 0, 2, big))
+	}
+	if n := r.Pending(); n != 2 {
+		t.Fatalf("pending=%d", n)
+	}
+	if _, ok := r.Add(chunk(1, 1, 2, "y")); ok {
+		t.Fatal("evicted record reassembled")
+	}
+	if rec, ok := r.Add(chunk(3, 1, 2, "y")); !ok || len(rec) != 4001 {
+		t.Fatalf("got %d bytes %v", len(rec), ok)
+	}
+}
+
+func TestSocketHandlerFramePerRecord(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testSocketFrame", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+
+	// IO线程会把多条合并成一批，但每条仍然单独一帧
+	for i := 0; i < 200; i++ {
+		logger.Info("record %d", i)
+	}
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 200; i++ {
+		s, err := readFrame(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("INFO - record %d\n", i); s != want {
+			t.Fatalf("got %q, want %q", s, want)
+		}
+	}
+	logger.Close()
+}
+
+func TestSocketHandlerFrameV2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetFrameV2("myapp")
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testSocketFrameV2", 1024))
+	logger := log.GetLogger("frameV2")
+	logger.SetHandler(h)
+	logger.SetFormatter(&log.TxtLineFormatter{})
+
+	before := time.Now()
+	logger.Warn("text record")
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.Error("json record")
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	hostname, _ := os.Hostname()
+	d := logframe.NewDecoder(c, 1<<20)
+	var f logframe.Frame
+	for i, want := range []struct {
+		level       int
+		contentType uint8
+		logger      string
+		body        string
+	}{
+		{log.LevelWarn, logframe.ContentText, "frameV2", "text record\n"},
+		{log.LevelError, logframe.ContentJSON, "frameV2", `"msg":"json record"`},
+		{log.LevelInfo, logframe.ContentText, "", "raw record"},
+	} {
+		if i == 2 {
+			// 直接写入的数据加上默认的帧头
+			h.Write([]byte("raw record"))
+		}
+		if err := d.Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		hdr := f.Header
+		if f.Version != logframe.Version2 || int(hdr.Level) != want.level ||
+			hdr.ContentType != want.contentType || hdr.Logger != want.logger ||
+			hdr.App != "myapp" || hdr.Hostname != hostname ||
+			hdr.Pid != uint32(os.Getpid()) {
+			t.Fatalf("frame %d: unexpected header %+v", i, hdr)
+		}
+		if !strings.Contains(string(f.Body), want.body) {
+			t.Fatalf("frame %d: got %q, want %q", i, f.Body, want.body)
+		}
+		if want.logger != "" && hdr.Timestamp.Before(before.Truncate(time.Second)) {
+			t.Fatalf("frame %d: timestamp %v", i, hdr.Timestamp)
+		}
+	}
+	logger.Close()
+}
+
+// 读出 n 帧，返回 session、每帧的 seq 与内容
+func readAckFrames(t *testing.T, d *logframe.Decoder, n int) (uint64, []uint64, []string) {
+	var session uint64
+	var seqs []uint64
+	var bodies []string
+	var f logframe.Frame
+	for i := 0; i < n; i++ {
+		if err := d.Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Header.Flags&logframe.FlagSeq == 0 {
+			t.Fatalf("frame without seq: %+v", f.Header)
+		}
+		session = f.Header.Session
+		seqs = append(seqs, f.Header.Seq)
+		bodies = append(bodies, string(f.Body))
+	}
+	return session, seqs, bodies
+}
+
+func waitUnacked(t *testing.T, h *log.SocketHandler, n int) {
+	for i := 0; i < 500; i++ {
+		if h.Unacked() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("unacked = %d, want %d", h.Unacked(), n)
+}
+
+func checkSeqs(t *testing.T, seqs []uint64, from uint64) {
+	for i, seq := range seqs {
+		if seq != from+uint64(i) {
+			t.Fatalf("seqs = %v, want from %d", seqs, from)
+		}
+	}
+}
+
+// 对方断开，没确认的帧重连后重发
+func testSocketHandlerAck(t *testing.T, spool bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)
+	if err := h.SetAck(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if spool {
+		dir, err := os.MkdirTemp("", "socketAck")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := h.SetSpool(dir, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testSocketAck", 1024))
+	logger := log.NewLogger(h, log.Llevel)
+
+	for i := 0; i < 10; i++ {
+		logger.Info("record %d", i)
+	}
+
+	// 第一个连接收到了但不确认
+	c1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, seqs, _ := readAckFrames(t, logframe.NewDecoder(c1, 1<<20), 10)
+	checkSeqs(t, seqs, 1)
+	waitUnacked(t, h, 10)
+	c1.Close()
+
+	n := 10
+	if spool {
+		// 断线期间的日志存到spool，和窗口中的一起按顺序重发
+		for i := 10; i < 15; i++ {
+			logger.Info("record %d", i)
+		}
+		n = 15
+	}
+
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	d := logframe.NewDecoder(c2, 1<<20)
+
+	session, seqs, bodies := readAckFrames(t, d, n)
+	checkSeqs(t, seqs, 1)
+	for i, body := range bodies {
+		if want := fmt.Sprintf("INFO - record %d\n", i); body != want {
+			t.Fatalf("got %q, want %q", body, want)
+		}
+	}
+
+	c2.Write(logframe.AppendAck(nil, session, uint64(n)))
+	waitUnacked(t, h, 0)
+
+	logger.Info("record %d", n)
+	_, seqs, _ = readAckFrames(t, d, 1)
+	checkSeqs(t, seqs, uint64(n+1))
+	c2.Write(logframe.AppendAck(nil, session, uint64(n+1)))
+	waitUnacked(t, h, 0)
+	logger.Close()
+}
+
+func TestSocketHandlerAck(t *testing.T)      { testSocketHandlerAck(t, false) }
+func TestSocketHandlerAckSpool(t *testing.T) { testSocketHandlerAck(t, true) }
+
+// Close 时还没确认的帧存到spool，重启后(新的 SocketHandler)先重发
+func TestSocketHandlerAckRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dir, err := os.MkdirTemp("", "socketAck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetAck(0, 100*time.Millisecond)
+	h.SetSpool(dir, 1<<20)
+	for i := 0; i < 3; i++ {
+		if _, err := h.Write([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	old, _, _ := readAckFrames(t, logframe.NewDecoder(c1, 1<<20), 3)
+	h.Close() // 等不到确认
+
+	h, _ = log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetAck(0, 5*time.Second)
+	h.SetSpool(dir, 1<<20)
+	defer h.Close()
+	if _, err := h.Write([]byte("record 3")); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	d := logframe.NewDecoder(c2, 1<<20)
+
+	// 上次的帧 session 与 seq 不变，对方可以去重
+	session, seqs, bodies := readAckFrames(t, d, 3)
+	if session != old {
+		t.Fatalf("session %x, want %x", session, old)
+	}
+	checkSeqs(t, seqs, 1)
+	c2.Write(logframe.AppendAck(nil, session, 3))
+
+	session2, seqs2, bodies2 := readAckFrames(t, d, 1)
+	if session2 == old {
+		t.Fatal("new handler should use a new session")
+	}
+	checkSeqs(t, seqs2, 1)
+	bodies = append(bodies, bodies2...)
+	for i, body := range bodies {
+		if want := fmt.Sprintf("record %d", i); body != want {
+			t.Fatalf("got %q, want %q", body, want)
+		}
+	}
+	c2.Write(logframe.AppendAck(nil, session2, 1))
+	waitUnacked(t, h, 0)
+}
+
+// 等窗口时对方确认后马上断开，IO线程醒来时连接已经没了
+func TestSocketHandlerAckConnClosed(t *testing.T) {
+	for _, spool := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var f logframe.Frame
+			if logframe.NewDecoder(c, 1<<20).Decode(&f) == nil {
+				c.Write(logframe.AppendAck(nil, f.Header.Session, f.Header.Seq))
+			}
+			c.Close()
+		}()
+
+		h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+		h.SetReconnectBackoff(time.Hour, time.Hour)
+		h.SetAck(1, time.Second)
+		if spool {
+			dir, err := os.MkdirTemp("", "socketAck")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			h.SetSpool(dir, 1<<20)
+		}
+
+		// 不能panic；没有spool时后两条返回错误
+		n, err := h.WriteBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		if spool && (n != 3 || err != nil) || !spool && (n < 1 || err == nil) {
+			t.Fatalf("spool=%v n=%d err=%v", spool, n, err)
+		}
+		h.Close()
+		ln.Close()
+	}
+}
+
+// 对方不确认，窗口满了以后超时断开重连
+func TestSocketHandlerAckTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h, _ := log.NewSocketHandler("tcp", ln.Addr().String())
+	h.SetReconnectBackoff(10*time.Millisecond, 50*time.Millisecond)
+	h.SetAck(2, 100*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := h.Write([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第三条等不到确认，连接被断开；没有spool，返回错误
+	if _, err := h.Write([]byte("record 2")); err == nil {
+		t.Fatal("expect ack timeout")
+	}
+
+	// 重连后重发窗口中的两条
+	c1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	d := logframe.NewDecoder(c2, 1<<20)
+	session, seqs, bodies := readAckFrames(t, d, 2)
+	checkSeqs(t, seqs, 1)
+	c2.Write(logframe.AppendAck(nil, session, 2))
+	waitUnacked(t, h, 0)
+
+	h.Write([]byte("record 3"))
+	_, seqs, bodies2 := readAckFrames(t, d, 1)
+	checkSeqs(t, seqs, 3)
+	if bodies[0] != "record 0" || bodies[1] != "record 1" || bodies2[0] != "record 3" {
+		t.Fatalf("unexpected bodies %q %q", bodies, bodies2)
+	}
+	c2.Write(logframe.AppendAck(nil, session, 3))
+	waitUnacked(t, h, 0)
+	h.Close()
+}
+
+// 外部实现的 RecordWriter
+type batchHandler struct {
+	*log.NullHandler
+	th      *log.HandleIOWriteThread
+	batches [][]string
+}
+
+func (h *batchHandler) AsyncWrite(fmt log.Formatter, l *log.LogInstance) {
+	h.th.AsyncWrite(h, fmt, l)
+}
+
+func (h *batchHandler) WriteBatch(records [][]byte) (int, error) {
+	var batch []string
+	for _, r := range records {
+		batch = append(batch, string(r))
+	}
+	h.batches = append(h.batches, batch)
+	return len(records), nil
+}
+
+func TestRecordWriter(t *testing.T) {
+	h := &batchHandler{
+		NullHandler: new(log.NullHandler),
+		th:          log.NewHandleIOWriteThread("testRecordWriter", 1024),
+	}
+	logger := log.NewLogger(h, log.Llevel)
+	for i := 0; i < 50; i++ {
+		logger.Info("r%d", i)
+	}
+	h.th.Close()
+
+	n := 0
+	for _, batch := range h.batches {
+		for _, r := range batch {
+			if want := fmt.Sprintf("INFO - r%d\n", n); r != want {
+				t.Fatalf("got %q, want %q", r, want)
+			}
+			n++
+		}
+	}
+	if n != 50 {
+		t.Fatalf("records=%d", n)
+	}
+}
@@ -0,0 +1,380 @@
+/*
+SyslogHandler 把日志发给 syslog (rsyslog/syslog-ng 等)：
+
+	// 本机 /dev/log
+	h, _ := log.NewSyslogHandler("", "", log.SyslogLocal0, "myapp")
+	// 远程，UDP 或 TCP(octet-counting 分帧)
+	h, _ := log.NewSyslogHandler("tcp", "10.0.0.1:514", log.SyslogLocal0, "myapp")
+	h.SetRFC(log.SyslogRFC3164)  // 默认 RFC5424
+
+	RFC5424 时 Fields 放在 SD-ELEMENT 中: [fields@32473 k1="v1" k2="2"]，
+	RFC3164 没有结构化数据，Fields 以 k=v 的形式加在 MSG 后面。
+	Logger 的 Formatter 对此handler无效，MSG 部分为: [file:[line] ]msg
+*/
+package log4go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SyslogRFC5424 = iota
+	SyslogRFC3164
+)
+
+// syslog facility
+const (
+	SyslogKern = iota
+	SyslogUser
+	SyslogMail
+	SyslogDaemon
+	SyslogAuth
+	SyslogSyslog
+	SyslogLpr
+	SyslogNews
+	SyslogUucp
+	SyslogCron
+	SyslogAuthpriv
+	SyslogFtp
+	_
+	_
+	_
+	_
+	SyslogLocal0
+	SyslogLocal1
+	SyslogLocal2
+	SyslogLocal3
+	SyslogLocal4
+	SyslogLocal5
+	SyslogLocal6
+	SyslogLocal7
+)
+
+// 日志级别对应的 syslog severity，下标为 LevelTrace..LevelBuss
+var SyslogSeverity = [...]int{
+	LevelTrace: 7, // debug
+	LevelDebug: 7, // debug
+	LevelInfo:  6, // informational
+	LevelWarn:  4, // warning
+	LevelError: 3, // err
+	LevelFatal: 2, // crit
+	LevelBuss:  5, // notice
+}
+
+// 默认的 SD-ID，32473 是 RFC5612 留给文档与示例用的企业号
+const DefaultSyslogSDID = "fields@32473"
+
+// network 为空时依次尝试这些本地socket
+var syslogLocalAddrs = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+//SyslogHandler writes log to syslog server, one message per record.
+type SyslogHandler struct {
+	network string
+	addr    string
+
+	rfc      int
+	facility int
+	hostname string
+	appName  string
+	procID   string
+	sdID     string
+
+	mu    sync.Mutex
+	c     net.Conn
+	frame []byte
+
+	fmt         *syslogFormatter
+	writeThread iHandleIOWriteThread
+}
+
+// network 可以是 udp, tcp, unix, unixgram，为空时连接本机的 /dev/log；
+// appName 为空时用程序名。
+func NewSyslogHandler(network string, addr string, facility int,
+	appName string) (*SyslogHandler, error) {
+
+	if facility < SyslogKern || facility > SyslogLocal7 {
+		return nil, fmt.Errorf("invalid syslog facility %d", facility)
+	}
+
+	switch network {
+	case "":
+		if addr != "" {
+			return nil, fmt.Errorf("syslog network is empty, addr=%s", addr)
+		}
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+
+	h := new(SyslogHandler)
+	h.network = network
+	h.addr = addr
+	h.facility = facility
+	h.appName = appName
+	if h.appName == "" {
+		h.appName = filepath.Base(os.Args[0])
+	}
+	h.hostname, _ = os.Hostname()
+	h.procID = strconv.Itoa(os.Getpid())
+	h.sdID = DefaultSyslogSDID
+	h.fmt = &syslogFormatter{h}
+	return h, nil
+}
+
+// SyslogRFC5424(默认) 或 SyslogRFC3164。
+// 以下Set方法都要在写日志之前调用。
+func (h *SyslogHandler) SetRFC(rfc int) {
+	h.rfc = rfc
+}
+
+func (h *SyslogHandler) SetHostname(hostname string) {
+	h.hostname = hostname
+}
+
+func (h *SyslogHandler) SetProcID(procID string) {
+	h.procID = procID
+}
+
+// Fields 所在 SD-ELEMENT 的 SD-ID，默认 DefaultSyslogSDID
+func (h *SyslogHandler) SetStructuredDataID(sdID string) {
+	h.sdID = sdID
+}
+
+// 忽略Logger的Formatter，用syslog的格式
+func (h *SyslogHandler) AsyncWrite(_ Formatter, log *LogInstance) {
+	if h.writeThread != nil {
+		h.writeThread.AsyncWrite(h, h.fmt, log)
+	} else {
+		globalWriteThread.AsyncWrite(h, h.fmt, log)
+	}
+}
+
+func (h *SyslogHandler) SetWriteIOThread(th iHandleIOWriteThread) {
+	h.writeThread = th
+}
+
+// p 当作一条日志
+func (h *SyslogHandler) Write(p []byte) (n int, err error) {
+	if _, err = h.WriteBatch([][]byte{p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *SyslogHandler) WriteBatch(records [][]byte) (n int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err = h.connect(); err != nil {
+		return
+	}
+
+	if h.datagram() {
+		// 一条日志一个报文
+		for _, r := range records {
+			if _, err = h.c.Write(r); err != nil {
+				break
+			}
+			n++
+		}
+	} else {
+		// 流式: tcp 用 octet-counting(RFC6587)，本地unix socket用换行分隔
+		frame := h.frame[:0]
+		for _, r := range records {
+			if h.network == "unix" {
+				frame = append(frame, r...)
+				frame = append(frame, '\n')
+			} else {
+				frame = strconv.AppendInt(frame, int64(len(r)), 10)
+				frame = append(frame, ' ')
+				frame = append(frame, r...)
+			}
+		}
+		h.frame = frame[:0]
+		if _, err = h.c.Write(frame); err == nil {
+			n = len(records)
+		}
+	}
+
+	if err != nil {
+		h.c.Close()
+		h.c = nil
+	}
+	return
+}
+
+func (h *SyslogHandler) datagram() bool {
+	return h.network == "unixgram" || strings.HasPrefix(h.network, "udp")
+}
+
+func (h *SyslogHandler) connect() (err error) {
+	if h.c != nil {
+		return nil
+	}
+
+	if h.network != "" {
+		h.c, err = net.DialTimeout(h.network, h.addr, 5*time.Second)
+		return
+	}
+
+	// 本机: 先试unixgram，再试unix
+	for _, addr := range syslogLocalAddrs {
+		for _, network := range []string{"unixgram", "unix"} {
+			if h.c, err = net.Dial(network, addr); err == nil {
+				h.network, h.addr = network, addr
+				return nil
+			}
+		}
+	}
+	return errors.New("unix syslog delivery error")
+}
+
+func (h *SyslogHandler) Close() error {
+	if h.writeThread != nil {
+		h.writeThread.Close()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.c != nil {
+		h.c.Close()
+		h.c = nil
+	}
+	return nil
+}
+
+//----------- syslog 格式 ------------------------
+
+type syslogFormatter struct {
+	h *SyslogHandler
+}
+
+func (f *syslogFormatter) Format(buff *bytes.Buffer,
+	l *LogInstance) (*bytes.Buffer, error) {
+
+	h := f.h
+	severity := 7
+	if l.LevelNo >= 0 && l.LevelNo < len(SyslogSeverity) {
+		severity = SyslogSeverity[l.LevelNo]
+	}
+
+	buff.WriteByte('<')
+	buff.WriteString(strconv.Itoa(h.facility<<3 | severity))
+	buff.WriteByte('>')
+
+	if h.rfc == SyslogRFC3164 {
+		// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+		buff.WriteString(l.Timestamp.Format(time.Stamp))
+		buff.WriteByte(' ')
+		buff.WriteString(syslogHeaderValue(h.hostname, 255))
+		buff.WriteByte(' ')
+		buff.WriteString(syslogHeaderValue(h.appName, 32))
+		buff.WriteByte('[')
+		buff.WriteString(h.procID)
+		buff.WriteString("]: ")
+		f.writeMsg(buff, l)
+		for _, k := range sortedKeys(l.KV) {
+			buff.WriteByte(' ')
+			buff.WriteString(k)
+			buff.WriteByte('=')
+			fmt.Fprint(buff, l.KV[k])
+		}
+	} else {
+		// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		buff.WriteString("1 ")
+		buff.WriteString(l.Timestamp.Format("2006-01-02T15:04:05.000000Z07:00"))
+		buff.WriteByte(' ')
+		buff.WriteString(syslogHeaderValue(h.hostname, 255))
+		buff.WriteByte(' ')
+		buff.WriteString(syslogHeaderValue(h.appName, 48))
+		buff.WriteByte(' ')
+		buff.WriteString(syslogHeaderValue(h.procID, 128))
+		buff.WriteString(" - ")
+		f.writeSD(buff, l.KV)
+		buff.WriteByte(' ')
+		f.writeMsg(buff, l)
+	}
+	return buff, nil
+}
+
+func (f *syslogFormatter) writeMsg(buff *bytes.Buffer, l *LogInstance) {
+	if l.Flag&Lfile > 0 && l.File != "" {
+		buff.WriteString(l.File)
+		buff.WriteByte(' ')
+	}
+	buff.WriteString(strings.TrimRight(l.Msg, "\n"))
+}
+
+// [SD-ID k="v" ...]，没有Fields时为 -
+func (f *syslogFormatter) writeSD(buff *bytes.Buffer, kv Fields) {
+	if len(kv) == 0 {
+		buff.WriteByte('-')
+		return
+	}
+
+	buff.WriteByte('[')
+	buff.WriteString(f.h.sdID)
+	for _, k := range sortedKeys(kv) {
+		buff.WriteByte(' ')
+		buff.WriteString(syslogSDName(k))
+		buff.WriteString(`="`)
+		sdValueEscaper.WriteString(buff, fmt.Sprint(kv[k]))
+		buff.WriteByte('"')
+	}
+	buff.WriteByte(']')
+}
+
+func sortedKeys(kv Fields) []string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PARAM-VALUE 中 '"' '\' ']' 要转义
+var sdValueEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// SD-NAME: 最多32个可打印ASCII字符，不能有 '=' ' ' ']' '"'，不合法的字符替换为 '_'
+func syslogSDName(s string) string {
+	return syslogToken(s, 32, func(c byte) bool {
+		return c == '=' || c == ']' || c == '"'
+	})
+}
+
+// HOSTNAME/APP-NAME/PROCID: 最多n个可打印ASCII字符，为空时用 -
+func syslogHeaderValue(s string, n int) string {
+	if s == "" {
+		return "-"
+	}
+	return syslogToken(s, n, func(byte) bool { return false })
+}
+
+func syslogToken(s string, n int, invalid func(c byte) bool) string {
+	if len(s) > n {
+		s = s[:n]
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c > '~' || invalid(c) {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if c := b[j]; c <= ' ' || c > '~' || invalid(c) {
+					b[j] = '_'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
@@ -0,0 +1,163 @@
+package log4go_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/kingsoft-wps/log4go"
+)
+
+func newSyslogLogger(t *testing.T, network, addr string) (*log.Logger, *log.SyslogHandler) {
+	h, err := log.NewSyslogHandler(network, addr, log.SyslogLocal0, "testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetHostname("host1")
+	h.SetProcID("42")
+	h.SetWriteIOThread(log.NewHandleIOWriteThread("testSyslog-"+network, 1024))
+
+	logger := log.NewLogger(h, log.Llevel)
+	logger.SetLevel(log.LevelTrace)
+	return logger, h
+}
+
+var rfc5424Re = regexp.MustCompile(
+	`(?s)^<(\d+)>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ host1 testapp 42 - (-|\[.*\]) (.*)$`)
+
+func TestSyslogHandlerUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	logger, _ := newSyslogLogger(t, "udp", pc.LocalAddr().String())
+	logger.Debug("debug msg")
+	logger.WithFields(log.Fields{"user": "bob", "q": `a"]\`}).Warn("warn msg")
+	logger.Error("error\nline2")
+	logger.Close()
+
+	want := []struct{ pri, sd, msg string }{
+		{"135", "-", "debug msg"},
+		{"132", `[fields@32473 q="a\"\]\\" user="bob"]`, "warn msg"},
+		{"131", "-", "error\nline2"},
+	}
+
+	buf := make([]byte, 64*1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, w := range want {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := rfc5424Re.FindStringSubmatch(string(buf[:n]))
+		if m == nil {
+			t.Fatalf("packet %d: %q", i, buf[:n])
+		}
+		if m[1] != w.pri || m[2] != w.sd || m[3] != w.msg {
+			t.Fatalf("packet %d: got %q", i, buf[:n])
+		}
+	}
+}
+
+func TestSyslogHandlerTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	msgs := make(chan string, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		// octet-counting: MSG-LEN SP SYSLOG-MSG
+		r := bufio.NewReader(c)
+		for {
+			s, err := r.ReadString(' ')
+			if err != nil {
+				close(msgs)
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(s))
+			b := make([]byte, n)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			msgs <- string(b)
+		}
+	}()
+
+	logger, h := newSyslogLogger(t, "tcp", ln.Addr().String())
+	h.SetRFC(log.SyslogRFC3164)
+	for i := 0; i < 3; i++ {
+		logger.WithField("n", i).Info("info %d", i)
+	}
+	logger.Buss("buss")
+	logger.Close()
+
+	re := regexp.MustCompile(`^<(\d+)>\w{3} [ \d]\d \d\d:\d\d:\d\d host1 testapp\[42\]: (.*)$`)
+	want := []string{"134 info 0 n=0", "134 info 1 n=1", "134 info 2 n=2", "133 buss"}
+	for i, w := range want {
+		var s string
+		select {
+		case s = <-msgs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d timeout", i)
+		}
+		m := re.FindStringSubmatch(s)
+		if m == nil || m[1]+" "+m[2] != w {
+			t.Fatalf("message %d: %q, want %q", i, s, w)
+		}
+	}
+}
+
+func TestSyslogHandlerUnixgram(t *testing.T) {
+	dir, err := os.MkdirTemp("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "log.sock")
+	pc, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+
+	logger, _ := newSyslogLogger(t, "unixgram", addr)
+	logger.Fatal("fatal")
+	logger.Close()
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := rfc5424Re.FindStringSubmatch(string(buf[:n])); m == nil || m[1] != "130" {
+		t.Fatalf("unexpected packet: %q", buf[:n])
+	}
+}
+
+func TestSyslogHandlerInvalid(t *testing.T) {
+	if _, err := log.NewSyslogHandler("http", "", log.SyslogUser, ""); err == nil {
+		t.Fatal("expect error for network http")
+	}
+	if _, err := log.NewSyslogHandler("udp", "127.0.0.1:514", 24, ""); err == nil {
+		t.Fatal("expect error for facility 24")
+	}
+}
@@ -0,0 +1,151 @@
+package log4go
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 可以用于 NewTimeFormatter 的常用layout
+const (
+	TimeFormatMilli       = "2006/01/02 15:04:05.000"
+	TimeFormatRFC3339Nano = time.RFC3339Nano
+	TimeFormatEpochMillis = "epoch_millis" // 输出1970年至今的毫秒数
+)
+
+// TimeFormatter 把日志时间格式化成字符串，可以并发使用。
+//
+// 同一秒内的时间只格式化一次：layout中秒以上的部分(以及时区)缓存起来，
+// 只有秒数变化时才重新调用 time.Format；
+// 如果layout带小数秒(如 .000 / .999999999)，小数部分每次单独拼接。
+type TimeFormatter struct {
+	layout      string
+	loc         *time.Location
+	epochMillis bool
+
+	// layout 中小数秒的位置 [fracStart, fracEnd)，没有时 fracStart=-1
+	fracStart  int
+	fracEnd    int
+	fracDigits int
+	fracTrim   bool // .999 的写法，去掉末尾的0
+
+	cache atomic.Value // *timeFormatCache
+}
+
+type timeFormatCache struct {
+	sec    int64
+	prefix string // 小数秒之前的部分，无小数秒时就是全部
+	suffix string // 小数秒之后的部分，如时区
+}
+
+// utc 为true时按UTC输出，否则按本地时区。
+func NewTimeFormatter(layout string, utc bool) *TimeFormatter {
+	tf := &TimeFormatter{
+		layout:    layout,
+		loc:       time.Local,
+		fracStart: -1,
+	}
+	if utc {
+		tf.loc = time.UTC
+	}
+
+	if layout == TimeFormatEpochMillis {
+		tf.epochMillis = true
+		return tf
+	}
+
+	// 与 time 包的规则一样: '.' 或 ',' 后跟连续的 0 或 9，且后面不是数字
+	for i := 0; i+1 < len(layout); i++ {
+		if c := layout[i]; c != '.' && c != ',' {
+			continue
+		}
+		ch := layout[i+1]
+		if ch != '0' && ch != '9' {
+			continue
+		}
+		j := i + 1
+		for j < len(layout) && layout[j] == ch {
+			j++
+		}
+		if j < len(layout) && layout[j] >= '0' && layout[j] <= '9' {
+			continue
+		}
+		tf.fracStart, tf.fracEnd = i, j
+		tf.fracDigits = j - i - 1
+		tf.fracTrim = ch == '9'
+		break
+	}
+	return tf
+}
+
+// 默认格式，与以前一样: "2006/01/02 15:04:05" 本地时间
+var defaultTimeFormatter = NewTimeFormatter(TimeFormat, false)
+
+func (tf *TimeFormatter) Layout() string {
+	return tf.layout
+}
+
+func (tf *TimeFormatter) Format(t time.Time) string {
+	if tf.epochMillis {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+
+	t = t.In(tf.loc)
+	sec := t.Unix()
+
+	c, _ := tf.cache.Load().(*timeFormatCache)
+	if c == nil || c.sec != sec {
+		c = tf.render(t, sec)
+		tf.cache.Store(c)
+	}
+
+	if tf.fracStart < 0 {
+		return c.prefix
+	}
+	return c.prefix + tf.formatFrac(t.Nanosecond()) + c.suffix
+}
+
+func (tf *TimeFormatter) render(t time.Time, sec int64) *timeFormatCache {
+	c := &timeFormatCache{sec: sec}
+	if tf.fracStart < 0 {
+		c.prefix = t.Format(tf.layout)
+		return c
+	}
+	c.prefix = t.Format(tf.layout[:tf.fracStart])
+	c.suffix = t.Format(tf.layout[tf.fracEnd:])
+	return c
+}
+
+func (tf *TimeFormatter) formatFrac(nsec int) string {
+	var buf [10]byte
+	buf[0] = tf.layout[tf.fracStart]
+
+	for i := 9; i > tf.fracDigits; i-- {
+		nsec /= 10
+	}
+	for i := tf.fracDigits; i > 0; i-- {
+		buf[i] = byte('0' + nsec%10)
+		nsec /= 10
+	}
+
+	n := tf.fracDigits + 1
+	if tf.fracTrim {
+		for n > 1 && buf[n-1] == '0' {
+			n--
+		}
+		if n == 1 {
+			return ""
+		}
+	}
+	return string(buf[:n])
+}
+
+// 设置此logger的时间格式，默认是 TimeFormat 本地时间，tf 为nil时恢复默认
+func (l *Logger) SetTimeFormatter(tf *TimeFormatter) {
+	if tf == nil {
+		tf = defaultTimeFormatter
+	}
+	l.timeFormatter = tf
+}
+
+func SetTimeFormatter(tf *TimeFormatter) { std.SetTimeFormatter(tf) }
@@ -73,12 +73,13 @@ func newTimeLogger(logDir string) *timeRollLogger {
 		closed: false,
 	}
 
+	t.wg.Add(1)
 	go t.run()
 	return t
 }
 
 func (self *timeRollLogger) run() {
-	self.wg.Add(1)
+	defer self.wg.Done()
 	for {
 		select {
 		case log := <-self.logs:
@@ -101,11 +102,10 @@ func (self *timeRollLogger) run() {
 			}
 
 		case <-self.quit:
-			break
+			self.close()
+			return
 		}
 	}
-
-	self.close()
 }
 
 func (self *timeRollLogger) WriteLog(log *logEntity) {
@@ -137,8 +137,7 @@ func (self *timeRollLogger) writeStringToBuff(en *fileEntity, nowSec int64, s st
 		n := copy(en.buff[en.size:], s)
 		en.size += n
 		s = s[n:]
-		en.file.Write(nowSec, en.buff[0:en.size])
-		en.size = 0
+		self.writeFile(en, nowSec)
 	}
 	n := copy(en.buff[en.size:], s)
 	en.size += n
@@ -147,12 +146,18 @@ func (self *timeRollLogger) writeStringToBuff(en *fileEntity, nowSec int64, s st
 func (self *timeRollLogger) writeBufferToFile(nowSec int64) {
 	for _, en := range self.dFiles {
 		if en.size > 0 {
-			en.file.Write(nowSec, en.buff[0:en.size])
-			en.size = 0
+			self.writeFile(en, nowSec)
 		}
 	}
 }
 
+func (self *timeRollLogger) writeFile(en *fileEntity, nowSec int64) {
+	if err := en.file.Write(nowSec, en.buff[0:en.size]); err != nil {
+		reportInternalError(err)
+	}
+	en.size = 0
+}
+
 func (self *timeRollLogger) getDayLogFile(fileName string) *fileEntity {
 	en, ok := self.dFiles[fileName]
 	if ok {
@@ -168,6 +173,7 @@ func (self *timeRollLogger) getDayLogFile(fileName string) *fileEntity {
 }
 
 func (self *timeRollLogger) close() {
+	self.writeBufferToFile(time.Now().Unix())
 	for _, en := range self.dFiles {
 		en.file.Close()
 	}
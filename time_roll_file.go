@@ -1,6 +1,7 @@
 package log4go
 
 import (
+	"fmt"
 	"os"
 	"time"
 )
@@ -50,8 +51,9 @@ func (self *TimeRollFile) Write(logTime int64, content []byte) error {
 		return err
 	}
 
+	// 不能用本包的Error()记录错误，日志本身可能就是写到这里的，会递归。
 	if _, err := f.Write(content); err != nil {
-		Error("[error]write file error, content=%s, filename=%s\n", content, self.curFileName)
+		return fmt.Errorf("write file %s error: %v", self.curFileName, err)
 	}
 	return nil
 }
@@ -64,7 +66,7 @@ func (self *TimeRollFile) WriteString(logTime int64, content string) error {
 	}
 
 	if _, err := f.WriteString(content); err != nil {
-		Error("[error]write file error, content=%s, filename=%s\n", content, self.curFileName)
+		return fmt.Errorf("write file %s error: %v", self.curFileName, err)
 	}
 	return nil
 }
@@ -72,11 +74,10 @@ func (self *TimeRollFile) WriteString(logTime int64, content string) error {
 func (self *TimeRollFile) Close() {
 	if self.file != nil {
 		if err := self.file.Close(); err != nil {
-			Error("[info]elf.osFile.Close() %s, err=%s", self.curFileName, err.Error())
+			reportInternalError(fmt.Errorf("close file %s error: %v", self.curFileName, err))
 		}
 
 		self.file = nil
-		Info("[info]close file %s", self.curFileName)
 	}
 }
 
@@ -120,11 +121,8 @@ func (self *TimeRollFile) getNewFile(logTime int64) (*os.File, error) {
 
 	f, err := os.OpenFile(self.curFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
-		Error("[info]open file %s, error=%v\n", self.curFileName, err)
 		return nil, err
 	}
 
-	Debug("[info]open file %s\n", self.curFileName)
-
 	return f, nil
 }